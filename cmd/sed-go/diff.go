@@ -0,0 +1,251 @@
+package main
+
+// This file makes the unified diffs for --dry-run.  The lines are
+// compared with Myers' O(ND) algorithm, in its linear-space form that
+// bisects the edit graph at the "middle snake", so even big files
+// with changes on every line don't need much memory.
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// diffContext is how many unchanged lines to show around each change.
+const diffContext = 3
+
+// diffOp is one line of an edit script: kind is ' ' for a line
+// in both files, '-' for a deleted line or '+' for an inserted one.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// splitLines splits text after each newline, so every line but
+// perhaps the last one keeps its "\n".
+func splitLines(text string) []string {
+	var lines []string
+	for len(text) > 0 {
+		idx := strings.IndexByte(text, '\n') + 1
+		if idx == 0 {
+			idx = len(text)
+		}
+		lines = append(lines, text[:idx])
+		text = text[idx:]
+	}
+	return lines
+}
+
+// diffLines gives the edit script that turns a into b.  Within each
+// run of changes, the deletions come before the insertions, as in
+// the output of diff -u.
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+	compareLines(a, b, &ops)
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		var run []diffOp
+		j := i
+		for ; j < len(ops) && ops[j].kind != ' '; j++ {
+			if ops[j].kind == '-' {
+				run = append(run, ops[j])
+			}
+		}
+		for k := i; k < j; k++ {
+			if ops[k].kind == '+' {
+				run = append(run, ops[k])
+			}
+		}
+		copy(ops[i:j], run)
+		i = j
+	}
+	return ops
+}
+
+// compareLines appends the edit script for a to b onto ops.
+func compareLines(a, b []string, ops *[]diffOp) {
+	// the common prefix and suffix are easy...
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		*ops = append(*ops, diffOp{' ', a[prefix]})
+		prefix++
+	}
+	a, b = a[prefix:], b[prefix:]
+
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-suffix-1] == b[len(b)-suffix-1] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	// ... and what's left in the middle gets split in two
+	x, y, ok := middleSnake(a, b)
+	if ok && (x > 0 || y > 0) && (x < len(a) || y < len(b)) {
+		compareLines(a[:x], b[:y], ops)
+		compareLines(a[x:], b[y:], ops)
+	} else {
+		for _, line := range a {
+			*ops = append(*ops, diffOp{'-', line})
+		}
+		for _, line := range b {
+			*ops = append(*ops, diffOp{'+', line})
+		}
+	}
+
+	for _, line := range common {
+		*ops = append(*ops, diffOp{' ', line})
+	}
+}
+
+// middleSnake searches for a shortest edit path from both ends at
+// once, and gives the point where the two searches meet.  It is not
+// ok when there's nothing in common between a and b.
+func middleSnake(a, b []string) (int, int, bool) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return 0, 0, false
+	}
+
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	vf := make([]int, 2*offset+1) // furthest x on each diagonal, searching forward
+	vr := make([]int, 2*offset+1) // furthest x on each diagonal, searching in reverse
+	for i := range vf {
+		vf[i], vr[i] = -1, -1
+	}
+	vf[offset+1], vr[offset+1] = 0, 0
+
+	delta := n - m
+	odd := delta%2 != 0
+	var fstart, fend, rstart, rend int // to skip diagonals that ran off the graph
+
+	for d := 0; d < maxD; d++ {
+		for k := -d + fstart; k <= d-fend; k += 2 {
+			var x int
+			if k == -d || (k != d && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			vf[offset+k] = x
+			switch {
+			case x > n:
+				fend += 2
+			case y > m:
+				fstart += 2
+			case odd:
+				rk := offset + delta - k
+				if rk >= 0 && rk < len(vr) && vr[rk] != -1 && x >= n-vr[rk] {
+					return x, y, true
+				}
+			}
+		}
+
+		for k := -d + rstart; k <= d-rend; k += 2 {
+			var x int
+			if k == -d || (k != d && vr[offset+k-1] < vr[offset+k+1]) {
+				x = vr[offset+k+1]
+			} else {
+				x = vr[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			vr[offset+k] = x
+			switch {
+			case x > n:
+				rend += 2
+			case y > m:
+				rstart += 2
+			case !odd:
+				fk := offset + delta - k
+				if fk >= 0 && fk < len(vf) && vf[fk] != -1 {
+					fx := vf[fk]
+					if fx >= n-x {
+						return fx, fx - (fk - offset), true
+					}
+				}
+			}
+		}
+	}
+
+	return 0, 0, false
+}
+
+// writeDiff writes a unified diff between the original and edited
+// text of a file.
+func writeDiff(w io.Writer, name, original, edited string) {
+	ops := diffLines(splitLines(original), splitLines(edited))
+
+	// apos and bpos count the lines of each file before each op
+	apos := make([]int, len(ops)+1)
+	bpos := make([]int, len(ops)+1)
+	for i, op := range ops {
+		apos[i+1], bpos[i+1] = apos[i], bpos[i]
+		if op.kind != '+' {
+			apos[i+1]++
+		}
+		if op.kind != '-' {
+			bpos[i+1]++
+		}
+	}
+
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", name, name)
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// a hunk keeps going while the changes are close together
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i + 1
+		for j := i; j < len(ops) && j-end <= 2*diffContext; j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			}
+		}
+		stop := end + diffContext
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		fmt.Fprintf(w, "@@ -%s +%s @@\n",
+			hunkRange(apos[start], apos[stop]), hunkRange(bpos[start], bpos[stop]))
+		for _, op := range ops[start:stop] {
+			fmt.Fprintf(w, "%c%s", op.kind, op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				fmt.Fprint(w, "\n\\ No newline at end of file\n")
+			}
+		}
+		i = stop
+	}
+}
+
+// hunkRange formats the lines from..to (counted from zero) the
+// way a hunk header wants them.
+func hunkRange(from, to int) string {
+	switch to - from {
+	case 0:
+		return fmt.Sprintf("%d,0", from)
+	case 1:
+		return fmt.Sprintf("%d", from+1)
+	default:
+		return fmt.Sprintf("%d,%d", from+1, to-from)
+	}
+}
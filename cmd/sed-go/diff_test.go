@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// checkOps makes sure the edit script turns a into b, and that
+// the deletions in each run of changes come before the insertions.
+// It gives back how many lines were changed.
+func checkOps(t *testing.T, a, b []string, ops []diffOp) int {
+	var gotA, gotB []string
+	changes := 0
+	for i, op := range ops {
+		if op.kind != '+' {
+			gotA = append(gotA, op.line)
+		}
+		if op.kind != '-' {
+			gotB = append(gotB, op.line)
+		}
+		if op.kind != ' ' {
+			changes++
+		}
+		if i > 0 && op.kind == '-' && ops[i-1].kind == '+' {
+			t.Errorf("a deletion follows an insertion in %v", ops)
+		}
+	}
+	if strings.Join(gotA, "") != strings.Join(a, "") || strings.Join(gotB, "") != strings.Join(b, "") {
+		t.Errorf("the ops for <%q> to <%q> rebuild <%q> and <%q>", a, b, gotA, gotB)
+	}
+	return changes
+}
+
+// lcsLength is the length of the longest common subsequence
+// of a and b, the slow and simple way.
+func lcsLength(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func TestDiffLines(t *testing.T) {
+	var tests = []struct {
+		a, b    string
+		changes int
+	}{
+		{"", "", 0},
+		{"a\nb\n", "a\nb\n", 0},
+		{"", "a\nb\n", 2},
+		{"a\nb\n", "", 2},
+		{"a\nb\nc\n", "a\nB\nc\n", 2},
+		{"a\nb\nc\nd\n", "b\nc\nd\ne\n", 2},
+		{"a\nb", "a\nb\n", 2},
+		{"x\ny\nx\ny\n", "y\nx\ny\nx\n", 2},
+	}
+	for _, test := range tests {
+		a, b := splitLines(test.a), splitLines(test.b)
+		if got := checkOps(t, a, b, diffLines(a, b)); got != test.changes {
+			t.Errorf("<%q> to <%q> took %d changes, not %d", test.a, test.b, got, test.changes)
+		}
+	}
+
+	// random files, from a small alphabet so there are lots of matches
+	rnd := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rnd.Intn(30))
+		for i := range lines {
+			lines[i] = string(rune('a'+rnd.Intn(4))) + "\n"
+		}
+		return lines
+	}
+	for i := 0; i < 2000; i++ {
+		a, b := randomLines(), randomLines()
+		changes := checkOps(t, a, b, diffLines(a, b))
+		if best := len(a) + len(b) - 2*lcsLength(a, b); changes != best {
+			t.Fatalf("<%q> to <%q> took %d changes, but %d would do", a, b, changes, best)
+		}
+	}
+}
+
+func TestWriteDiff(t *testing.T) {
+	var twenty []string
+	for i := 1; i <= 20; i++ {
+		twenty = append(twenty, fmt.Sprintf("%d\n", i))
+	}
+	changed := func(lines ...int) string {
+		b := append([]string(nil), twenty...)
+		for _, l := range lines {
+			b[l-1] = "changed\n"
+		}
+		return strings.Join(b, "")
+	}
+
+	var tests = []struct {
+		original, edited string
+		expected         string
+	}{
+		{"a\nb\nc\n", "a\nb\nc\n", ""},
+		{"a\nb\nc\n", "a\nB\nc\n", "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{"", "x\n", "@@ -0,0 +1 @@\n+x\n"},
+		{"x\n", "", "@@ -1 +0,0 @@\n-x\n"},
+		{"a\n", "a\nb", "@@ -1 +1,2 @@\n a\n+b\n\\ No newline at end of file\n"},
+		{"a", "b", "@@ -1 +1 @@\n-a\n\\ No newline at end of file\n+b\n\\ No newline at end of file\n"},
+
+		// changes 2*diffContext lines apart share a hunk...
+		{strings.Join(twenty, ""), changed(1, 8),
+			"@@ -1,11 +1,11 @@\n-1\n+changed\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+changed\n 9\n 10\n 11\n"},
+		// ... and any further apart get their own
+		{strings.Join(twenty, ""), changed(1, 9),
+			"@@ -1,4 +1,4 @@\n-1\n+changed\n 2\n 3\n 4\n" +
+				"@@ -6,7 +6,7 @@\n 6\n 7\n 8\n-9\n+changed\n 10\n 11\n 12\n"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		writeDiff(&out, "f", test.original, test.edited)
+		expected := "--- f\n+++ f\n" + test.expected
+		if out.String() != expected {
+			t.Errorf("diff of <%q> and <%q> was\n%s\ninstead of\n%s", test.original, test.edited, out.String(), expected)
+		}
+	}
+}
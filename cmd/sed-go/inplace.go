@@ -0,0 +1,275 @@
+package main
+
+// This file holds the in-place editing (-i) logic.  The edited
+// file is written to a temporary file in the same directory, which
+// is synced to disk and then renamed over the original, so that an
+// interrupted run leaves either the old file or the new one, and
+// never half of each.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rwtodd/Go.Sed/sed"
+)
+
+// inplaceOptions are the settings for prepareEdit and commit.
+type inplaceOptions struct {
+	suffix         string // the backup suffix, if any (-iSUFFIX)
+	followSymlinks bool   // edit the target of a symlink, instead of replacing it
+	preserveMtime  bool   // give the edited file its old modification time
+}
+
+// failure is an error that knows the exit code main should use for it.
+type failure struct {
+	code int
+	err  error
+}
+
+func (f *failure) Error() string {
+	return f.err.Error()
+}
+
+func fail(code int, format string, args ...interface{}) error {
+	return &failure{code, fmt.Errorf(format, args...)}
+}
+
+// exitCodeOf gives the exit code for an error, which is 2 for
+// anything that isn't a failure.
+func exitCodeOf(err error) int {
+	var f *failure
+	if errors.As(err, &f) {
+		return f.code
+	}
+	return 2
+}
+
+// temps is the set of temporary files being written, so
+// they can be removed if we are interrupted.
+var temps = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// removeTempsOnSignal waits for an interrupt, and then removes
+// any temporary files before exiting.  The originals are untouched,
+// since they are only ever replaced by a rename.
+func removeTempsOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	<-ch
+
+	temps.Lock()
+	for name := range temps.names {
+		os.Remove(name)
+	}
+	os.Exit(130)
+}
+
+// pendingEdit is an edited file, sitting in a temporary file until
+// it is committed over the original, or aborted.
+type pendingEdit struct {
+	target   string      // the file being replaced
+	tempName string      // the temporary file holding the edit
+	stat     os.FileInfo // the original's stat, from before the edit
+	opts     *inplaceOptions
+}
+
+// prepareEdit is the first half of an in-place edit, running the
+// engine over filename into a temporary file which is synced to disk.
+// Whatever goes wrong, the temporary file is cleaned up, the original
+// is left as it was, and the edit is nil.  If the script quits, the
+// edit is given back along with the *sed.ExitError.  The second half
+// is the edit's commit (or abort), which -j leaves to the main
+// goroutine so that files are replaced in order.
+func prepareEdit(engine *sed.Engine, filename string, opts *inplaceOptions) (*pendingEdit, error) {
+	target := filename
+	if opts.followSymlinks {
+		var err error
+		target, err = filepath.EvalSymlinks(filename)
+		if err != nil {
+			return nil, fail(3, "following symlink '%s' failed: %s", filename, err)
+		}
+	}
+
+	stat, err := os.Stat(target)
+	if err != nil {
+		return nil, fail(8, "stat of '%s' failed: %s", target, err)
+	}
+
+	input, err := os.Open(target)
+	if err != nil {
+		return nil, fail(3, "open input file '%s' failed: %s", target, err)
+	}
+	defer input.Close()
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(target), filepath.Base(target)+"-*")
+	if err != nil {
+		return nil, fail(4, "failed to create temporary file: %s", err)
+	}
+	edit := &pendingEdit{target: target, tempName: tempFile.Name(), stat: stat, opts: opts}
+	temps.Lock()
+	temps.names[edit.tempName] = true
+	temps.Unlock()
+
+	ready := false
+	defer func() {
+		if !ready {
+			tempFile.Close()
+			edit.abort()
+		}
+	}()
+
+	_, runErr := io.Copy(tempFile, engine.WrapAll(sed.Input{Name: filename, Reader: input}))
+	if _, quit := quitCode(runErr); runErr != nil && !quit {
+		return nil, fail(5, "engine failed on file '%s': %s", filename, runErr)
+	}
+
+	if err = tempFile.Chmod(stat.Mode()); err != nil {
+		return nil, fail(9, "set mode of '%s' failed: %s", edit.tempName, err)
+	}
+	setOwner(edit.tempName, stat)
+
+	if err = tempFile.Sync(); err != nil {
+		return nil, fail(7, "syncing temporary file '%s' failed: %s", edit.tempName, err)
+	}
+	if err = tempFile.Close(); err != nil {
+		return nil, fail(7, "closing temporary file '%s' failed: %s", edit.tempName, err)
+	}
+
+	if opts.preserveMtime {
+		if err = os.Chtimes(edit.tempName, time.Now(), stat.ModTime()); err != nil {
+			return nil, fail(12, "setting the times of '%s' failed: %s", edit.tempName, err)
+		}
+	}
+
+	ready = true
+	return edit, runErr
+}
+
+// commit makes the backup, if one was asked for, and renames the
+// edit over the original.  If it fails, the edit is aborted.
+func (e *pendingEdit) commit() error {
+	if e.opts.suffix != "" {
+		backup := backupName(e.target, e.opts.suffix)
+		if err := makeBackup(e.target, backup, e.stat); err != nil {
+			e.abort()
+			return fail(11, "backing up '%s' to '%s' failed: %s", e.target, backup, err)
+		}
+	}
+
+	if err := os.Rename(e.tempName, e.target); err != nil {
+		e.abort()
+		return fail(10, "renaming tempfile '%s' to %s failed: %s", e.tempName, e.target, err)
+	}
+	e.forget()
+
+	// the rename itself has to reach the disk, too
+	if err := syncDir(filepath.Dir(e.target)); err != nil {
+		return fail(13, "syncing the directory of '%s' failed: %s", e.target, err)
+	}
+	return nil
+}
+
+// abort throws the edit away, leaving the original alone.
+func (e *pendingEdit) abort() {
+	os.Remove(e.tempName)
+	e.forget()
+}
+
+// forget takes the temporary file off the list to clean up.
+func (e *pendingEdit) forget() {
+	temps.Lock()
+	delete(temps.names, e.tempName)
+	temps.Unlock()
+}
+
+// syncDir flushes a directory's entries to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// backupName works out where the backup of filename goes, given the
+// suffix from -iSUFFIX.  As in GNU sed, any '*' in the suffix is replaced
+// by the name of the file, so 'bak/*' puts the backups in a 'bak' directory
+// next to each file.  Without a '*', the suffix is added to the name.
+func backupName(filename, suffix string) string {
+	base := filepath.Base(filename)
+	if strings.ContainsRune(suffix, '*') {
+		base = strings.Replace(suffix, "*", base, -1)
+	} else {
+		base += suffix
+	}
+	return filepath.Join(filepath.Dir(filename), base)
+}
+
+// makeBackup saves a copy of filename as backup, replacing any older
+// backup.  A hard link is tried first, since it keeps everything about the
+// original.  Otherwise, the copy gets the original's mode and ownership.
+func makeBackup(filename, backup string, stat os.FileInfo) error {
+	err := os.Remove(backup)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.Link(filename, backup) == nil {
+		return nil
+	}
+
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(backup, os.O_CREATE|os.O_EXCL|os.O_WRONLY, stat.Mode())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Chmod(stat.Mode())
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	setOwner(backup, stat)
+	return nil
+}
+
+// setOwner gives the file the same UID/GID as stat, where the
+// platform supports it.
+func setOwner(name string, stat os.FileInfo) {
+	tmp := stat.Sys()
+	statSys, ok := tmp.(*syscall.Stat_t)
+	if ok {
+		err := os.Chown(name, int(statSys.Uid), int(statSys.Gid))
+		if err != nil {
+			// errors might be platform related, just warn
+			fmt.Fprintf(os.Stderr, "failed to set UID/GID on '%s': %s\n", name, err)
+		}
+	}
+}
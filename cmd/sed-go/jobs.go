@@ -0,0 +1,122 @@
+package main
+
+// This file runs the separate-file modes (-s, -i and --dry-run)
+// over many files at once, for -j.  The files are processed by a
+// pool of workers, but the results are always handled in the order
+// of the command line, so the output and errors are the same as
+// they would be one file at a time.
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// fileResult is what came of processing one file.
+type fileResult struct {
+	output  *bytes.Buffer // output held back for stdout, when running in parallel
+	edit    *pendingEdit  // for -i, the edit waiting to be committed
+	changed bool          // for --dry-run, would the file change?
+	err     error         // any error, or the *sed.ExitError of a quit
+}
+
+// forEachFile calls work on each file, with up to jobs of them
+// running at once, and gives the results to handle in order. Any
+// output and pending edit are taken care of before handle sees the
+// result.  It stops at the first error, which may be a quit, and
+// returns it.  The edits of any files after that are aborted.
+func forEachFile(files []string, jobs int,
+	work func(filename string, w io.Writer) *fileResult,
+	handle func(res *fileResult) error) error {
+
+	if jobs <= 1 {
+		for _, filename := range files {
+			if err := finishResult(work(filename, os.Stdout), handle); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	results := make([]chan *fileResult, len(files))
+	for i := range results {
+		results[i] = make(chan *fileResult, 1)
+	}
+
+	// the window keeps the workers from getting too far
+	// ahead of the results, holding output in memory
+	window := make(chan struct{}, 2*jobs)
+	next := make(chan int)
+	stop := make(chan struct{})
+	go func() {
+		defer close(next)
+		for i := range files {
+			select {
+			case window <- struct{}{}:
+			case <-stop:
+				return
+			}
+			select {
+			case next <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				var buf bytes.Buffer
+				res := work(files[i], &buf)
+				res.output = &buf
+				results[i] <- res
+			}
+		}()
+	}
+
+	var err error
+	for i := range files {
+		err = finishResult(<-results[i], handle)
+		<-window
+		if err != nil {
+			// throw away the work that was done on later files
+			close(stop)
+			wg.Wait()
+			for _, ch := range results[i+1:] {
+				select {
+				case res := <-ch:
+					if res.edit != nil {
+						res.edit.abort()
+					}
+				default:
+				}
+			}
+			break
+		}
+	}
+	return err
+}
+
+// finishResult writes out any held-back output, commits any edit,
+// and passes the result on to handle.
+func finishResult(res *fileResult, handle func(res *fileResult) error) error {
+	if res.output != nil {
+		if _, err := os.Stdout.Write(res.output.Bytes()); err != nil {
+			if res.edit != nil {
+				res.edit.abort()
+			}
+			return err
+		}
+	}
+	if res.edit != nil {
+		if err := res.edit.commit(); err != nil {
+			return err
+		}
+	}
+	return handle(res)
+}
@@ -1,33 +1,95 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"path"
+	"runtime"
 	"strings"
-	"syscall"
 
 	"github.com/rwtodd/Go.Sed/sed"
 )
 
 var noPrint bool
-var sedFile string
 
-type evalStrings []string
+// scriptPart is one -e or -f argument.  Together, they
+// make up the program, in the order they were given.
+type scriptPart struct {
+	isFile bool
+	text   string // the expression, or the name of the file
+}
+
+var scriptParts []scriptPart
+
+// scriptValue is the -e flag, or the -f flag when isFile is set.
+type scriptValue struct {
+	isFile bool
+}
+
+func (_ scriptValue) String() string {
+	return ""
+}
+
+func (sv scriptValue) Set(v string) error {
+	scriptParts = append(scriptParts, scriptPart{sv.isFile, v})
+	return nil
+}
 
-var evalProg evalStrings
+type stringList []string
 
 var inplace bool
+var backupSuffix string
+
+// inplaceValue is the -i (or --in-place) flag, which takes an optional
+// backup suffix.  The flag package can't do optional values, so
+// fixInplaceArgs rewrites a bare -i into -i= before parsing.
+type inplaceValue struct{}
+
+func (_ inplaceValue) String() string {
+	return backupSuffix
+}
+
+func (_ inplaceValue) Set(v string) error {
+	inplace = true
+	backupSuffix = v
+	return nil
+}
+
+var extendedRE bool
+var basicRE bool
+
+var allowExec bool
+var sandbox bool
 
-func (es *evalStrings) String() string {
-	return strings.Join(*es, " ; ")
+var nullData bool
+
+var lineEndings string
+
+var separate bool
+
+var dryRun bool
+
+var jobs int
+
+var recursive bool
+var includes stringList
+var excludes stringList
+var ignoreFiles stringList
+var binaryFiles bool
+
+var followSymlinks bool
+var preserveMtime bool
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ", ")
 }
 
-func (es *evalStrings) Set(v string) error {
-	*es = append(*es, v)
+func (sl *stringList) Set(v string) error {
+	*sl = append(*sl, v)
 	return nil
 }
 
@@ -36,32 +98,75 @@ func init() {
 	flag.BoolVar(&noPrint, "silent", false, "do not automatically print lines")
 	flag.BoolVar(&noPrint, "quiet", false, "do not automatically print lines")
 
-	flag.Var(&evalProg, "e", "a string to evaluate as the program")
-	flag.Var(&evalProg, "expression", "a string to evaluate as the program")
+	flag.Var(scriptValue{false}, "e", "a string to add to the program")
+	flag.Var(scriptValue{false}, "expression", "a string to add to the program")
+
+	flag.Var(scriptValue{true}, "f", "a file to add to the program ('-' for stdin)")
+	flag.Var(scriptValue{true}, "file", "a file to add to the program ('-' for stdin)")
+
+	flag.Var(inplaceValue{}, "i", "change file(s) inplace, keeping backups if a SUFFIX is given (-iSUFFIX)")
+	flag.Var(inplaceValue{}, "in-place", "change file(s) inplace, keeping backups if a SUFFIX is given (--in-place=SUFFIX)")
 
-	flag.StringVar(&sedFile, "f", "", "a file to read as the program")
-	flag.StringVar(&sedFile, "file", "", "a file to read as the program")
+	flag.BoolVar(&dryRun, "dry-run", false, "show a diff of the changes to each file, without changing anything (rejects w and e)")
+	flag.BoolVar(&dryRun, "diff", false, "show a diff of the changes to each file, without changing anything (rejects w and e)")
 
-	flag.BoolVar(&inplace, "i", false, "change file(s) inplace")
+	flag.IntVar(&jobs, "j", 1, "with -i, -s or --dry-run, process up to N files at once (0 for one per CPU)")
+	flag.IntVar(&jobs, "jobs", 1, "with -i, -s or --dry-run, process up to N files at once (0 for one per CPU)")
+
+	flag.BoolVar(&recursive, "R", false, "process the files under any directories given")
+	flag.BoolVar(&recursive, "recursive", false, "process the files under any directories given")
+	flag.Var(&includes, "include", "with -R, only process files matching this glob (repeatable)")
+	flag.Var(&excludes, "exclude", "with -R, skip files and directories matching this glob (repeatable)")
+	flag.Var(&ignoreFiles, "ignore-file", "with -R, skip what's listed in files of this name, like .gitignore (repeatable)")
+	flag.BoolVar(&binaryFiles, "binary", false, "with -R, process binary files instead of skipping them")
+
+	flag.BoolVar(&followSymlinks, "follow-symlinks", false, "with -i, edit the file a symlink points to, rather than replacing the link")
+	flag.BoolVar(&preserveMtime, "preserve-mtime", false, "with -i, keep the modification time of each file")
+
+	flag.BoolVar(&extendedRE, "E", false, "use POSIX extended regexps (ERE)")
+	flag.BoolVar(&extendedRE, "r", false, "use POSIX extended regexps (ERE)")
+	flag.BoolVar(&extendedRE, "regexp-extended", false, "use POSIX extended regexps (ERE)")
+	flag.BoolVar(&basicRE, "basic-regexp", false, "use POSIX basic regexps (BRE) instead of Go's syntax")
+
+	flag.BoolVar(&allowExec, "allow-exec", false, "allow the script to run shell commands (s///e)")
+	flag.BoolVar(&sandbox, "sandbox", false, "reject the r, R, w, W and e commands, and the w and e modifiers of s")
+
+	flag.BoolVar(&nullData, "z", false, "separate lines by NUL characters")
+	flag.BoolVar(&nullData, "null-data", false, "separate lines by NUL characters")
+
+	flag.BoolVar(&separate, "s", false, "treat files as separate, rather than one continuous stream")
+	flag.BoolVar(&separate, "separate", false, "treat files as separate, rather than one continuous stream")
+
+	flag.StringVar(&lineEndings, "line-endings", "preserve", "how to end output lines: preserve, lf or crlf")
 }
 
 func compileScript(args *[]string) (*sed.Engine, error) {
 	var program io.Reader
 
-	// STEP ONE: Find the script
-	switch {
-	case len(evalProg) > 0:
-		program = strings.NewReader(evalProg.String())
-		if sedFile != "" {
-			return nil, fmt.Errorf("Cannot specify both an expression and a program file!")
-		}
-	case sedFile != "":
-		fl, err := os.Open(sedFile)
-		if err != nil {
-			return nil, fmt.Errorf("Error opening %s: %v", sedFile, err)
+	// STEP ONE: Find the script, from every -e and -f in order
+	var parts []sed.Input
+	exprs := 0
+	for _, part := range scriptParts {
+		switch {
+		case !part.isFile:
+			exprs++
+			name := fmt.Sprintf("-e expression #%d", exprs)
+			parts = append(parts, sed.Input{Name: name, Reader: strings.NewReader(part.text)})
+		case part.text == "-":
+			parts = append(parts, sed.Input{Name: "stdin", Reader: os.Stdin})
+		default:
+			fl, err := os.Open(part.text)
+			if err != nil {
+				return nil, fmt.Errorf("Error opening %s: %v", part.text, err)
+			}
+			defer fl.Close()
+			parts = append(parts, sed.Input{Name: part.text, Reader: fl})
 		}
-		defer fl.Close()
-		program = fl
+	}
+
+	switch {
+	case len(parts) > 0:
+		program = sed.NewScript(parts...)
 	case len(*args) > 0:
 		// no -e or -f given, so the first argument is taken as the script to run
 		program = strings.NewReader((*args)[0])
@@ -73,16 +178,144 @@ func compileScript(args *[]string) (*sed.Engine, error) {
 	}
 
 	// STEP TWO: compile the program
-	var compiler func(io.Reader) (*sed.Engine, error)
+	var opts []sed.Option
+	switch {
+	case extendedRE && basicRE:
+		return nil, fmt.Errorf("Cannot ask for both basic and extended regexps!")
+	case extendedRE:
+		opts = append(opts, sed.WithDialect(sed.ERE))
+	case basicRE:
+		opts = append(opts, sed.WithDialect(sed.BRE))
+	}
+	if allowExec {
+		opts = append(opts, sed.AllowExec())
+	}
+	if sandbox {
+		opts = append(opts, sed.Sandbox())
+	}
+	if dryRun {
+		// a preview must not touch the disk, so it can't let 'w' write
+		// files or 'e' run commands, but 'r' can still read
+		opts = append(opts, sed.ReadOnly())
+	}
+	if nullData {
+		opts = append(opts, sed.LineSeparator("\x00"))
+	}
+	switch lineEndings {
+	case "preserve":
+		// the default
+	case "lf":
+		opts = append(opts, sed.WithLineEnding(sed.LFEndings))
+	case "crlf":
+		opts = append(opts, sed.WithLineEnding(sed.CRLFEndings))
+	default:
+		return nil, fmt.Errorf("Unknown line ending <%s>, expected preserve, lf or crlf", lineEndings)
+	}
+
 	if noPrint {
-		compiler = sed.NewQuiet
-	} else {
-		compiler = sed.New
+		opts = append(opts, sed.Quiet())
 	}
-	return compiler(program)
+	return sed.Compile(program, opts...)
+}
+
+// reportCompileError prints what's wrong with the script,
+// pointing out where each syntax error is.
+func reportCompileError(err error) {
+	var errs sed.SyntaxErrors
+	if !errors.As(err, &errs) {
+		fmt.Fprintf(os.Stderr, "script compile failed: %s\n", err)
+		return
+	}
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "script compile failed: %s\n%s", e, e.Snippet())
+	}
+}
+
+// quitCode pulls the exit code out of the error from a script
+// that ended with 'q N' or 'Q N'.
+func quitCode(err error) (int, bool) {
+	var exitErr *sed.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code, true
+	}
+	return 0, false
+}
+
+// lazyFile is a file on the command line, which is opened on its
+// first Read and closed at its end, so that a long list of files
+// never has more than one of them open at a time.
+type lazyFile struct {
+	name string
+	f    *os.File
+	done bool
+}
+
+func (in *lazyFile) Read(p []byte) (int, error) {
+	if in.done {
+		return 0, io.EOF
+	}
+	if in.f == nil {
+		f, err := os.Open(in.name)
+		if err != nil {
+			return 0, err
+		}
+		in.f = f
+	}
+	n, err := in.f.Read(p)
+	if err == io.EOF {
+		in.f.Close()
+		in.done = true
+	}
+	return n, err
+}
+
+// fixInplaceArgs turns the GNU-style '-i', '-iSUFFIX' and '--in-place'
+// arguments into the '-i=SUFFIX' form that the flag package understands.
+// Anything that names another flag (like -include=*.go) is left alone,
+// and so is everything after the flags end, just as flag.Parse sees them.
+func fixInplaceArgs(args []string) {
+	for idx := 0; idx < len(args); idx++ {
+		arg := args[idx]
+		if arg == "--" || arg == "-" || !strings.HasPrefix(arg, "-") {
+			return
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		hasValue := strings.Contains(name, "=")
+		if hasValue {
+			name = name[:strings.Index(name, "=")]
+		}
+
+		switch {
+		case name == "i" || name == "in-place":
+			if !hasValue {
+				args[idx] = arg + "="
+			}
+		case flag.Lookup(name) != nil:
+			if !hasValue && takesValue(name) {
+				idx++ // skip over the value, like the 's/a/b/' of '-e s/a/b/'
+			}
+		case strings.HasPrefix(arg, "-i"):
+			args[idx] = "-i=" + arg[2:]
+		}
+	}
+}
+
+// takesValue is true for the flags that need a value, which
+// flag.Parse takes from the next argument when there's no '='.
+func takesValue(name string) bool {
+	f := flag.Lookup(name)
+	if f == nil {
+		return false
+	}
+	if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+		return false
+	}
+	return true
 }
 
 func main() {
+	fixInplaceArgs(os.Args[1:])
 	flag.Parse()
 	args := flag.Args()
 	var err error
@@ -90,86 +323,148 @@ func main() {
 	// Find and compile the script
 	engine, err := compileScript(&args)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "script compile failed: %s\n", err)
+		reportCompileError(err)
 		os.Exit(1)
 	}
 
-	if len(args) == 0 {
-		_, err = io.Copy(os.Stdout, engine.Wrap(os.Stdin))
+	switch {
+	case jobs == 0:
+		jobs = runtime.NumCPU()
+	case jobs < 0:
+		fmt.Fprintf(os.Stderr, "bad number of jobs: %d\n", jobs)
+		os.Exit(1)
+	}
+
+	if recursive {
+		if len(args) == 0 {
+			args = []string{"."}
+		}
+		args, err = expandArgs(args, &walkOptions{
+			includes:    includes,
+			excludes:    excludes,
+			ignoreFiles: ignoreFiles,
+			binary:      binaryFiles,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "searching for files failed: %s\n", err)
+			os.Exit(3)
+		}
+		if len(args) == 0 {
+			// nothing to do, and stdin isn't what was asked for
+			os.Exit(0)
+		}
+	}
+
+	if dryRun && len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "--dry-run needs some files to check")
+		os.Exit(1)
+	}
+
+	if len(args) == 0 || !(separate || inplace || dryRun) {
+		// one continuous stream, from stdin or all of the files
+		var inputs []sed.Input
+		for _, filename := range args {
+			inputs = append(inputs, sed.Input{Name: filename, Reader: &lazyFile{name: filename}})
+		}
+		if len(inputs) == 0 {
+			inputs = append(inputs, sed.Input{Name: "-", Reader: os.Stdin})
+		}
+
+		_, err = io.Copy(os.Stdout, engine.WrapAll(inputs...))
+		if code, quit := quitCode(err); quit {
+			os.Exit(code)
+		}
+		var skipped sed.InputErrors
+		if errors.As(err, &skipped) {
+			// like GNU sed, the other files were still processed
+			for _, e := range skipped {
+				fmt.Fprintf(os.Stderr, "%s\n", e)
+			}
+			os.Exit(2)
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "engine failed: %s\n", err)
 			os.Exit(2)
 		}
 	} else {
-		for _, filename := range args {
-			var inputFile *os.File
-			inputFile, err = os.Open(filename)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "open input file '%s' failed: %s\n", filename, err)
-				os.Exit(3)
-			}
+		// each file separately, which -i and --dry-run always do
+		opts := inplaceOptions{
+			suffix:         backupSuffix,
+			followSymlinks: followSymlinks,
+			preserveMtime:  preserveMtime,
+		}
+		go removeTempsOnSignal()
 
-			var (
-				target   io.Writer = os.Stdout
-				tempFile *os.File
-			)
-			if inplace {
-				tempFilename := fmt.Sprintf("%s-*", path.Base(filename))
-				tempFile, err = ioutil.TempFile(path.Dir(filename), tempFilename)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "failed to create temporary file: %s\n", err)
-					os.Exit(4)
+		exitCode := 0
+		changed := 0
+		err = forEachFile(args, jobs,
+			func(filename string, w io.Writer) *fileResult {
+				var res fileResult
+				switch {
+				case dryRun:
+					res.changed, res.err = previewFile(engine, filename, w)
+				case inplace:
+					res.edit, res.err = prepareEdit(engine, filename, &opts)
+				default:
+					res.err = printFile(engine, filename, w)
 				}
-				target = tempFile
-			}
-
-			_, err = io.Copy(target, engine.Wrap(inputFile))
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "engine failed on file '%s': %s\n", filename, err)
-				os.Exit(5)
-			}
+				return &res
+			},
+			func(res *fileResult) error {
+				if res.changed {
+					changed++
+				}
+				return res.err
+			})
 
-			inputFile.Close()
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "closing input file '%s' failed: %s\n", filename, err)
-				os.Exit(6)
-			}
+		if code, quit := quitCode(err); quit {
+			// the file that quit was finished, but no others were started
+			exitCode = code
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitCodeOf(err))
+		}
+		if dryRun {
+			// the summary goes to stderr, so the diff can be fed to patch
+			fmt.Fprintf(os.Stderr, "%d of %d files would change\n", changed, len(args))
+		}
+		os.Exit(exitCode)
+	}
+}
 
-			if inplace {
-				stat, err := os.Stat(filename)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "stat of '%s' failed: %s\n", filename, err)
-					os.Exit(8)
-				}
+// previewFile runs the engine over a single file, and prints a diff
+// of what it would change, without touching the file.  It reports
+// whether there were any changes.
+func previewFile(engine *sed.Engine, filename string, w io.Writer) (bool, error) {
+	original, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, fail(3, "reading input file '%s' failed: %s", filename, err)
+	}
 
-				err = tempFile.Chmod(stat.Mode())
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "set mode of '%s' failed: %s\n", tempFile.Name(), err)
-					os.Exit(9)
-				}
+	var edited bytes.Buffer
+	_, err = io.Copy(&edited, engine.WrapAll(sed.Input{Name: filename, Reader: bytes.NewReader(original)}))
+	if _, quit := quitCode(err); err != nil && !quit {
+		return false, fail(5, "engine failed on file '%s': %s", filename, err)
+	}
 
-				tempFile.Close()
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "closing temporary file '%s' failed: %s\n", tempFile.Name(), err)
-					os.Exit(7)
-				}
+	if bytes.Equal(original, edited.Bytes()) {
+		return false, err
+	}
+	writeDiff(w, filename, string(original), edited.String())
+	return true, err
+}
 
-				tmp := stat.Sys()
-				statSys, ok := tmp.(*syscall.Stat_t)
-				if ok {
-					err = os.Chown(tempFile.Name(), int(statSys.Uid), int(statSys.Gid))
-					if err != nil {
-						// errors might be platform related, just warn
-						fmt.Fprintf(os.Stderr, "failed to set UID/GID on tempfile '%s': %s\n", tempFile.Name(), err)
-					}
-				}
+// printFile runs the engine over a single file, writing to w.
+func printFile(engine *sed.Engine, filename string, w io.Writer) error {
+	input, err := os.Open(filename)
+	if err != nil {
+		return fail(3, "open input file '%s' failed: %s", filename, err)
+	}
+	defer input.Close()
 
-				err = os.Rename(tempFile.Name(), filename)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "renaming tempfile '%s' to %s failed: %s\n", tempFile.Name(), filename, err)
-					os.Exit(10)
-				}
-			}
-		}
+	_, err = io.Copy(w, engine.WrapAll(sed.Input{Name: filename, Reader: input}))
+	if _, quit := quitCode(err); err != nil && !quit {
+		return fail(5, "engine failed on file '%s': %s", filename, err)
 	}
+	return err
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFixInplaceArgs(t *testing.T) {
+	var tests = []struct {
+		args     string
+		expected string
+	}{
+		{"-i -e s/a/b/ a.txt", "-i= -e s/a/b/ a.txt"},
+		{"--in-place s/a/b/ a.txt", "--in-place= s/a/b/ a.txt"},
+		{"-i.bak s/a/b/ a.txt", "-i=.bak s/a/b/ a.txt"},
+		{"-i=.bak --in-place=.orig s/a/b/", "-i=.bak --in-place=.orig s/a/b/"},
+		{"-e s/a/b/ -i a.txt", "-e s/a/b/ -i= a.txt"},
+
+		// other flags that start with 'i' are not -i
+		{"-ignore-file=.gi -e s/hello/HI/ a.txt", "-ignore-file=.gi -e s/hello/HI/ a.txt"},
+		{"-include=*.go -R s/a/b/ .", "-include=*.go -R s/a/b/ ."},
+		{"--ignore-file .gi -include *.go -R s/a/b/ .", "--ignore-file .gi -include *.go -R s/a/b/ ."},
+
+		// a flag's value, and anything after the flags, are left alone
+		{"-e -ifoo a.txt", "-e -ifoo a.txt"},
+		{"s/a/b/ -i a.txt", "s/a/b/ -i a.txt"},
+		{"-n -- -i a.txt", "-n -- -i a.txt"},
+	}
+	for _, test := range tests {
+		args := strings.Fields(test.args)
+		fixInplaceArgs(args)
+		if got := strings.Join(args, " "); got != test.expected {
+			t.Errorf("for <%s> expected <%s>, got <%s>", test.args, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+// This file expands the directories on the command line into the
+// files under them, for -R.  Files can be picked out with --include
+// and --exclude globs, and with .gitignore-style ignore files.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// walkOptions are the settings for expandArgs.
+type walkOptions struct {
+	includes    []string // globs a file must match one of, if any are given
+	excludes    []string // globs for files and directories to skip
+	ignoreFiles []string // names of ignore files to read in each directory
+	binary      bool     // process binary files, rather than skipping them
+}
+
+// vcsDirs are never walked into, since their contents are
+// not something a user means to edit.
+var vcsDirs = map[string]bool{".git": true, ".hg": true, ".svn": true}
+
+// binarySniffLen is how much of a file to check for NULs to decide
+// that it is binary, the same amount git and GNU grep check.
+const binarySniffLen = 8000
+
+// expandArgs replaces each directory in args with the files under it.
+// Plain files are kept as they are, even if they don't match the filters.
+func expandArgs(args []string, opts *walkOptions) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil || !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+
+		w := walker{root: arg, opts: opts}
+		if err = filepath.Walk(arg, w.visit); err != nil {
+			return nil, err
+		}
+		files = append(files, w.files...)
+	}
+	return files, nil
+}
+
+// walker collects the files under one directory.
+type walker struct {
+	root  string
+	opts  *walkOptions
+	rules []ignoreRule // the rules from all the ignore files seen so far
+	files []string
+}
+
+func (w *walker) visit(path string, info os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+
+	if info.IsDir() {
+		if rel != "." && (vcsDirs[info.Name()] || w.excluded(rel) || w.ignored(rel, true)) {
+			return filepath.SkipDir
+		}
+		return w.readIgnoreFiles(path, rel)
+	}
+
+	// symlinks and devices are left alone, like in grep -r
+	if !info.Mode().IsRegular() || w.excluded(rel) || w.ignored(rel, false) {
+		return nil
+	}
+	if len(w.opts.includes) > 0 && !globsMatch(w.opts.includes, rel) {
+		return nil
+	}
+	if !w.opts.binary {
+		binary, err := isBinary(path)
+		if err != nil {
+			return err
+		}
+		if binary {
+			return nil
+		}
+	}
+
+	w.files = append(w.files, path)
+	return nil
+}
+
+func (w *walker) excluded(rel string) bool {
+	return globsMatch(w.opts.excludes, rel)
+}
+
+// globsMatch checks a relative path against shell globs.  A glob
+// with a '/' has to match the whole path, and any other glob only
+// has to match the last part of it.
+func globsMatch(globs []string, rel string) bool {
+	for _, glob := range globs {
+		name := rel
+		if !strings.Contains(glob, "/") {
+			name = rel[strings.LastIndex(rel, "/")+1:]
+		}
+		if ok, _ := filepath.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isBinary reports if a file looks binary, which is when it has
+// a NUL near the beginning.  With -z, NULs are normal, and no file
+// is considered binary.
+func isBinary(path string) (bool, error) {
+	if nullData {
+		return false, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, binarySniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return bytes.IndexByte(buf[:n], 0) >= 0, nil
+}
+
+// ignoreRule is one line of an ignore file.
+type ignoreRule struct {
+	dir     string         // where the ignore file was, relative to the root ("." for the root)
+	re      *regexp.Regexp // matches paths relative to dir
+	negate  bool           // a '!' rule, which un-ignores
+	dirOnly bool           // a rule ending in '/', for directories only
+}
+
+// ignored checks a path against the ignore rules.  As in git,
+// the last rule to match a path decides if it is ignored.
+func (w *walker) ignored(rel string, isDir bool) bool {
+	result := false
+	for _, rule := range w.rules {
+		sub := rel
+		if rule.dir != "." {
+			if !strings.HasPrefix(rel, rule.dir+"/") {
+				continue
+			}
+			sub = rel[len(rule.dir)+1:]
+		}
+		if (isDir || !rule.dirOnly) && rule.re.MatchString(sub) {
+			result = !rule.negate
+		}
+	}
+	return result
+}
+
+// readIgnoreFiles loads the rules of any ignore files in a directory.
+func (w *walker) readIgnoreFiles(path, rel string) error {
+	for _, name := range w.opts.ignoreFiles {
+		f, err := os.Open(filepath.Join(path, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(f)
+		lineno := 0
+		for scanner.Scan() {
+			lineno++
+			rule, ok, err := parseIgnoreRule(scanner.Text())
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("%s:%d: %v", filepath.Join(path, name), lineno, err)
+			}
+			if ok {
+				rule.dir = rel
+				w.rules = append(w.rules, rule)
+			}
+		}
+		f.Close()
+		if err = scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseIgnoreRule turns a .gitignore-style line into a rule.  It
+// isn't ok if the line is blank or a comment.
+func parseIgnoreRule(line string) (ignoreRule, bool, error) {
+	var rule ignoreRule
+
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false, nil
+	}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:] // for a leading \# or \!
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	// a pattern without a '/' can match at any depth
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	line = strings.TrimPrefix(line, "/")
+
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case strings.HasPrefix(line[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(line[i:], "/**") && i+3 == len(line):
+			re.WriteString("/.*")
+			i += 2
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(line[i+1:], ']')
+			if end < 0 {
+				return rule, false, fmt.Errorf("unterminated [ in pattern")
+			}
+			class := line[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(line):
+			i++
+			re.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		}
+	}
+	re.WriteString("$")
+
+	var err error
+	rule.re, err = regexp.Compile(re.String())
+	return rule, true, err
+}
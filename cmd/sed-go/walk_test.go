@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	// the rules of one ignore file in the root, and one in "sub"
+	var w walker
+	for _, line := range []string{
+		"# a comment", "", "*.log", "!keep.log", "/top", "build/", "doc/**/*.md",
+		"logs/**", "file[!0-9].txt", `\#hash`, "a/b",
+	} {
+		rule, ok, err := parseIgnoreRule(line)
+		if err != nil {
+			t.Fatalf("rule <%s> failed: %v", line, err)
+		}
+		if ok {
+			rule.dir = "."
+			w.rules = append(w.rules, rule)
+		}
+	}
+	rule, _, _ := parseIgnoreRule("*.tmp")
+	rule.dir = "sub"
+	w.rules = append(w.rules, rule)
+
+	var tests = []struct {
+		rel     string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.log", false, true},
+		{"x/y/b.log", false, true},
+		{"a.txt", false, false},
+		{"keep.log", false, false},
+		{"x/keep.log", false, false},
+		{"top", false, true},
+		{"x/top", false, false},
+		{"build", true, true},
+		{"x/build", true, true},
+		{"build", false, false},
+		{"doc/a.md", false, true},
+		{"doc/x/y/a.md", false, true},
+		{"a.md", false, false},
+		{"logs/a", false, true},
+		{"logs/x/y", false, true},
+		{"logs", true, false},
+		{"filea.txt", false, true},
+		{"file1.txt", false, false},
+		{"#hash", false, true},
+		{"a/b", false, true},
+		{"x/a/b", false, false},
+		{"sub/a.tmp", false, true},
+		{"sub/x/a.tmp", false, true},
+		{"a.tmp", false, false},
+	}
+	for _, test := range tests {
+		if got := w.ignored(test.rel, test.isDir); got != test.ignored {
+			t.Errorf("ignored(%s, dir=%v) was %v", test.rel, test.isDir, got)
+		}
+	}
+
+	if _, _, err := parseIgnoreRule("bad["); err == nil {
+		t.Errorf("an unterminated [ should be an error")
+	}
+}
+
+func TestGlobsMatch(t *testing.T) {
+	var tests = []struct {
+		glob  string
+		rel   string
+		match bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "x/y/main.go", true},
+		{"*.go", "main.c", false},
+		{"x/*.go", "x/main.go", true},
+		{"x/*.go", "z/x/main.go", false},
+		{"sub", "sub", true},
+		{"sub", "x/sub", true},
+	}
+	for _, test := range tests {
+		if got := globsMatch([]string{test.glob}, test.rel); got != test.match {
+			t.Errorf("globsMatch(%s, %s) was %v", test.glob, test.rel, got)
+		}
+	}
+}
+
+func TestExpandArgs(t *testing.T) {
+	root, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	files := map[string]string{
+		".gi":          "build/\n*.log\n",
+		"a.txt":        "a\n",
+		"b.log":        "b\n",
+		"bin.dat":      "bin\x00ary\n",
+		".git/config":  "x\n",
+		"build/d.txt":  "d\n",
+		"sub/.gi":      "*.txt\n!keep.txt\n",
+		"sub/c.txt":    "c\n",
+		"sub/keep.txt": "keep\n",
+	}
+	for name, text := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in := func(names ...string) []string {
+		var paths []string
+		for _, name := range names {
+			paths = append(paths, filepath.Join(root, filepath.FromSlash(name)))
+		}
+		return paths
+	}
+
+	var tests = []struct {
+		args     []string
+		opts     walkOptions
+		expected []string
+	}{
+		{[]string{root}, walkOptions{ignoreFiles: []string{".gi"}, includes: []string{"*.txt"}},
+			in("a.txt", "sub/keep.txt")},
+		{[]string{root}, walkOptions{ignoreFiles: []string{".gi"}, excludes: []string{"sub"}, binary: true},
+			in(".gi", "a.txt", "bin.dat")},
+		{[]string{root}, walkOptions{excludes: []string{".gi", "sub/*"}},
+			in("a.txt", "b.log", "build/d.txt")},
+
+		// plain files are kept, even when the filters would skip them
+		{in("b.log", "bin.dat"), walkOptions{ignoreFiles: []string{".gi"}, includes: []string{"*.txt"}},
+			in("b.log", "bin.dat")},
+	}
+	for _, test := range tests {
+		got, err := expandArgs(test.args, &test.opts)
+		if err != nil {
+			t.Fatalf("expandArgs(%v) failed: %v", test.args, err)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("expandArgs(%v, %+v) gave %v, expected %v", test.args, test.opts, got, test.expected)
+		}
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/rwtodd/Go.Sed
 
-go 1.13
+go 1.16
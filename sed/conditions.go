@@ -1,46 +1,134 @@
-package sed 
+package sed
 
 import (
 	"fmt"
 	"regexp"
+	"strings"
 )
 
 // conditions are what I'm calling the '1,10' in
 // commands ike '1,10 d'.  They are the line numbers,
 // regexps, and '$' that you can use to control when
-// commands execute.
+// commands execute.  Only regexps can fail to be checked
+// (an empty // with no previous regexp), but they all
+// return an error to keep the interface uniform.
 
 type condition interface {
-	isMet(svm *vm) bool
+	isMet(svm *vm) (bool, error)
+}
+
+// endcondition is what closes a two-condition range.  Some of
+// them (like the '+3' in '/re/,+3') only make sense relative to
+// the line where the range started, so they are given that line
+// number as 'first'.  The check happens on the starting line as
+// well, so that ranges like '5,3' stop right away.
+type endcondition interface {
+	isEnd(svm *vm, first int) (bool, error)
 }
 
 // -----------------------------------------------------
 type numbercond int // for matching line number conditions
 
-func (n numbercond) isMet(svm *vm) bool {
-	return svm.lineno == int(n)
+func (n numbercond) isMet(svm *vm) (bool, error) {
+	return svm.lineno == int(n), nil
+}
+
+func (n numbercond) isEnd(svm *vm, first int) (bool, error) {
+	return svm.lineno >= int(n), nil
+}
+
+// -----------------------------------------------------
+type zerocond struct{} // for the '0' in '0,/re/'
+
+// isMet is true on the first line, but a range started
+// by a zerocond acts like it was started before the first
+// line, so the regexp gets a chance to end it right away.
+func (_ zerocond) isMet(svm *vm) (bool, error) {
+	return svm.lineno == 1, nil
+}
+
+// -----------------------------------------------------
+type stepcond struct { // for matching 'first~step' conditions
+	first int
+	step  int
+}
+
+func (s stepcond) isMet(svm *vm) (bool, error) {
+	if s.step <= 0 {
+		return svm.lineno == s.first, nil
+	}
+	return (svm.lineno >= s.first) && ((svm.lineno-s.first)%s.step == 0), nil
+}
+
+// -----------------------------------------------------
+type relativecond int // for ending ranges like 'addr,+N'
+
+func (n relativecond) isEnd(svm *vm, first int) (bool, error) {
+	return svm.lineno >= first+int(n), nil
+}
+
+// -----------------------------------------------------
+type multiplecond int // for ending ranges like 'addr,~N'
+
+func (n multiplecond) isEnd(svm *vm, first int) (bool, error) {
+	return (n <= 0) || (svm.lineno%int(n) == 0), nil
 }
 
 // -----------------------------------------------------
 type eofcond struct{} // for matching the condition '$'
 
-func (_ eofcond) isMet(svm *vm) bool {
-	return svm.lastl
+func (_ eofcond) isMet(svm *vm) (bool, error) {
+	return svm.lastl, nil
+}
+
+func (_ eofcond) isEnd(svm *vm, first int) (bool, error) {
+	return svm.lastl, nil
 }
 
 // -----------------------------------------------------
 type regexpcond struct {
-	re *regexp.Regexp // for matching regexp conditions
+	re *regexp.Regexp // for matching regexp conditions, nil for //
 }
 
-func (r *regexpcond) isMet(svm *vm) (answer bool) {
-	return r.re.MatchString(svm.pat)
+func (r *regexpcond) isMet(svm *vm) (bool, error) {
+	re, err := svm.useRegexp(r.re)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(svm.pat), nil
 }
 
-func newRECondition(s string, loc *location) (*regexpcond, error) {
-	re, err := regexp.Compile(s)
+// isEnd never looks at the line that started the range,
+// so '/a/,/b/' on a line with both 'a' and 'b' stays on.
+func (r *regexpcond) isEnd(svm *vm, first int) (bool, error) {
+	if svm.lineno == first {
+		return false, nil
+	}
+	return r.isMet(svm)
+}
+
+// newRECondition compiles a regexp address. The flags
+// are the 'I' and 'M' that can follow the address.
+func newRECondition(s string, flags string, d Dialect) (*regexpcond, error) {
+	var reflags string
+	if strings.ContainsRune(flags, 'I') {
+		reflags += "i"
+	}
+	if strings.ContainsRune(flags, 'M') {
+		reflags += "m"
+	}
+
+	if len(s) == 0 {
+		// the empty regexp means the last one used, at runtime
+		if len(reflags) > 0 {
+			return nil, fmt.Errorf("Regexp Error: no flags allowed on an empty regexp")
+		}
+		return &regexpcond{nil}, nil
+	}
+
+	re, err := compileRegexp(s, d, reflags)
 	if err != nil {
-		err = fmt.Errorf("Regexp Error: %s %v", err.Error(), loc)
+		err = fmt.Errorf("Regexp Error: %s", err.Error())
 	}
 	return &regexpcond{re}, err
 }
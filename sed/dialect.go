@@ -0,0 +1,299 @@
+package sed
+
+// This file translates the classic POSIX regular expression
+// dialects into the RE2 syntax that Go's regexp package
+// understands.  The engine still runs everything through
+// Go's regexp, so the translation is purely textual.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Dialect selects the regular expression syntax used by
+// a sed program, in both addresses and substitutions.
+type Dialect int
+
+const (
+	// GoRE is Go's own regexp syntax, with $1-style references
+	// in replacements.  It is the default.
+	GoRE Dialect = iota
+
+	// BRE is POSIX basic regular expression syntax, as used by a
+	// traditional sed: s/a\(bc*\)d/\1/g.  The common GNU extensions
+	// \+, \? and \| are also accepted.
+	BRE
+
+	// ERE is POSIX extended regular expression syntax, like the
+	// -E or -r switches of GNU sed: s/a(bc*)d/\1/g.
+	ERE
+)
+
+// compileRegexp translates a pattern from the given dialect and
+// compiles it.  The POSIX dialects use leftmost-longest matching
+// and let '.' match a newline, just like a traditional sed. Any
+// flags (like "i" for the sed 'I' modifier) are given to RE2 as
+// a (?flags) prefix.
+func compileRegexp(pattern string, d Dialect, flags string) (*regexp.Regexp, error) {
+	translated, err := translateRegexp(pattern, d)
+	if err != nil {
+		return nil, err
+	}
+	if len(flags) > 0 {
+		translated = "(?" + flags + ")" + translated
+	}
+
+	re, err := regexp.Compile(translated)
+	if err == nil && d != GoRE {
+		re.Longest()
+	}
+	return re, err
+}
+
+// translateRegexp rewrites a BRE or ERE into RE2 syntax.  GoRE
+// patterns are returned untouched.
+func translateRegexp(pattern string, d Dialect) (string, error) {
+	if d == GoRE || len(pattern) == 0 {
+		return pattern, nil
+	}
+
+	var out strings.Builder
+	out.WriteString("(?s)")
+
+	rs := []rune(pattern)
+
+	// atStart is true wherever a '*' would have nothing to
+	// repeat, and where a BRE '^' is still an anchor.
+	atStart := true
+
+	for i := 0; i < len(rs); i++ {
+		c := rs[i]
+		wasStart := atStart
+		atStart = false
+
+		switch {
+		case c == '\\':
+			i++
+			if i == len(rs) {
+				return "", fmt.Errorf("trailing backslash in regexp")
+			}
+			c = rs[i]
+			switch {
+			case d == BRE && c == '(':
+				out.WriteRune('(')
+				atStart = true
+			case d == BRE && c == ')':
+				out.WriteRune(')')
+			case d == BRE && c == '|':
+				out.WriteRune('|')
+				atStart = true
+			case d == BRE && c == '{':
+				end := strings.Index(string(rs[i+1:]), `\}`)
+				if end < 0 {
+					return "", fmt.Errorf("unmatched \\{ in regexp")
+				}
+				interval := string(rs[i+1:])[:end]
+				translated, err := translateInterval(interval)
+				if err != nil {
+					return "", fmt.Errorf("bad interval \\{%s\\} in regexp", interval)
+				}
+				out.WriteString(translated)
+				i += len([]rune(interval)) + 2
+			case d == BRE && (c == '+' || c == '?') && !wasStart:
+				out.WriteRune(c)
+			case c >= '1' && c <= '9':
+				return "", fmt.Errorf("back-reference \\%c is not supported in a regexp (Go's regexp package cannot express it)", c)
+			case c == '<' || c == '>':
+				return "", fmt.Errorf("word boundary \\%c is not supported in a regexp, use \\b instead", c)
+			case c == '`':
+				out.WriteString(`\A`)
+			case c == '\'':
+				out.WriteString(`\z`)
+			case strings.ContainsRune("wWsSbBntrfv", c):
+				out.WriteRune('\\')
+				out.WriteRune(c)
+			default:
+				out.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		case c == '[':
+			class, end, err := translateBracket(rs, i)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(class)
+			i = end
+		case c == '^':
+			if d == BRE && !wasStart {
+				out.WriteString(`\^`)
+			} else {
+				out.WriteRune('^')
+				atStart = true
+			}
+		case c == '$':
+			if d == BRE && !breAnchorsEnd(rs, i) {
+				out.WriteString(`\$`)
+			} else {
+				out.WriteRune('$')
+			}
+		case c == '*' && wasStart:
+			out.WriteString(`\*`)
+		case d == BRE && strings.ContainsRune("(){}|+?", c):
+			out.WriteRune('\\')
+			out.WriteRune(c)
+		case d == ERE && (c == '+' || c == '?' || c == '{') && wasStart:
+			out.WriteRune('\\')
+			out.WriteRune(c)
+		case d == ERE && c == '{' && strings.ContainsRune(string(rs[i:]), '}'):
+			interval := string(rs[i+1:])[:strings.IndexRune(string(rs[i+1:]), '}')]
+			if strings.Trim(interval, "0123456789,") != "" {
+				out.WriteRune(c) // not an interval, so RE2 takes it literally
+				break
+			}
+			translated, err := translateInterval(interval)
+			if err != nil {
+				return "", fmt.Errorf("bad interval {%s} in regexp", interval)
+			}
+			out.WriteString(translated)
+			i += len([]rune(interval)) + 1
+		case d == ERE && (c == '(' || c == '|'):
+			out.WriteRune(c)
+			atStart = true
+		default:
+			out.WriteRune(c)
+		}
+	}
+
+	return out.String(), nil
+}
+
+// breAnchorsEnd decides if the '$' at rs[i] is an anchor in a BRE,
+// which is only true at the end of the pattern or a group.
+func breAnchorsEnd(rs []rune, i int) bool {
+	rest := string(rs[i+1:])
+	return rest == "" || strings.HasPrefix(rest, `\)`) || strings.HasPrefix(rest, `\|`)
+}
+
+// translateInterval checks the inside of a POSIX interval, like
+// the '2,3' of 'x\{2,3\}', and gives back the RE2 version.  A
+// missing lower bound means zero, as in GNU sed, since RE2 would
+// take '{,3}' as plain text.
+func translateInterval(interval string) (string, error) {
+	bounds := strings.Split(interval, ",")
+	if len(bounds) > 2 || strings.Trim(interval, "0123456789,") != "" || (len(bounds) == 1 && interval == "") {
+		return "", fmt.Errorf("bad interval")
+	}
+	if bounds[0] == "" {
+		bounds[0] = "0"
+	}
+	return "{" + strings.Join(bounds, ",") + "}", nil
+}
+
+// translateBracket copies the POSIX bracket expression that starts
+// at rs[i] into RE2 syntax. It returns the translation, and the index
+// of the closing ']'. Backslashes are literal inside POSIX brackets,
+// except for the \n, \t and \\ escapes that GNU sed allows.
+func translateBracket(rs []rune, i int) (string, int, error) {
+	var out strings.Builder
+	out.WriteRune('[')
+	i++
+
+	if i < len(rs) && rs[i] == '^' {
+		out.WriteRune('^')
+		i++
+	}
+	if i < len(rs) && rs[i] == ']' {
+		out.WriteString(`\]`)
+		i++
+	}
+
+	for ; i < len(rs); i++ {
+		c := rs[i]
+		var next rune
+		if i+1 < len(rs) {
+			next = rs[i+1]
+		}
+
+		switch {
+		case c == ']':
+			out.WriteRune(']')
+			return out.String(), i, nil
+		case c == '[' && next == ':':
+			end := strings.Index(string(rs[i+2:]), ":]")
+			if end < 0 {
+				return "", i, fmt.Errorf("unterminated character class in regexp")
+			}
+			class := string(rs[i+2:])[:end]
+			out.WriteString("[:" + class + ":]")
+			i += len([]rune(class)) + 3
+		case c == '[' && (next == '.' || next == '='):
+			return "", i, fmt.Errorf("[%c %c] is not supported in a regexp", next, next)
+		case c == '[':
+			out.WriteString(`\[`)
+		case c == '\\' && strings.ContainsRune(`nt\`, next):
+			out.WriteRune(c)
+			out.WriteRune(next)
+			i++
+		case c == '\\':
+			out.WriteString(`\\`)
+		default:
+			out.WriteRune(c)
+		}
+	}
+
+	return "", i, fmt.Errorf("unterminated [ in regexp")
+}
+
+// translateReplacement interprets the backslash escapes in the
+// replacement of an 's' command, producing a template for
+// newReplTemplate.  Every dialect understands \n, \t, \r and \\,
+// and passes the case conversions \U, \L, \E, \u and \l along.
+// The POSIX dialects turn \1 and & into ${1} and ${0}, and \& into
+// a literal '&'.  In GoRE, $1 is already a reference, and any other
+// escaped character is just that character.
+func translateReplacement(raw string, d Dialect) string {
+	var out strings.Builder
+	posix := d != GoRE
+
+	literal := func(c rune) {
+		switch {
+		case posix && c == '$':
+			out.WriteString("$$")
+		case c == '\\':
+			out.WriteString(`\\`)
+		default:
+			out.WriteRune(c)
+		}
+	}
+
+	rs := []rune(raw)
+	for i := 0; i < len(rs); i++ {
+		c := rs[i]
+		switch {
+		case c == '\\' && i+1 < len(rs):
+			i++
+			c = rs[i]
+			switch {
+			case c == 'n':
+				out.WriteRune('\n')
+			case c == 't':
+				out.WriteRune('\t')
+			case c == 'r':
+				out.WriteRune('\r')
+			case strings.ContainsRune("ULEul", c):
+				out.WriteRune('\\')
+				out.WriteRune(c)
+			case posix && c >= '0' && c <= '9':
+				out.WriteString("${" + string(c) + "}")
+			default:
+				literal(c)
+			}
+		case posix && c == '&':
+			out.WriteString("${0}")
+		default:
+			literal(c)
+		}
+	}
+
+	return out.String()
+}
@@ -1,8 +1,8 @@
 // Package sed implements the classic UNIX sed language in pure Go.
 // The interface is very simple: a user compiles a program into an
-// execution engine by calling New or NewQuiet. Then, the engine
-// can Wrap() any io.Reader to lazily process the stream as you
-// read from it.
+// execution engine by calling Compile (or New or NewQuiet), with any
+// Options it needs. Then, the engine can Wrap() any io.Reader to
+// lazily process the stream as you read from it.
 //
 // All classic sed commands are supported, but since the package
 // uses Go's regexp package for the regular expressions, the syntax
@@ -11,83 +11,472 @@
 // So this is a Go-flavored sed, rather than a drop-in replacement for
 // a UNIX sed.  Depending on your tastes, you will either consider this
 // an improvement or completely brain-dead.
+//
+// If you'd rather have the traditional syntax, compile the program
+// with the WithDialect(BRE) or WithDialect(ERE) option, and the
+// regexps will be translated for you.
 package sed
 
 import (
 	"bufio"
 	"bytes"
-        "strings"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"regexp"
+	"strings"
 )
 
 // Engine is the compiled instruction stream for a sed program.
 // It is the main type that users of the go-sed library will
 // interact with.
+//
+// An Engine is never modified after it is compiled. All of the
+// state for a run lives in the reader returned by Wrap, so a
+// single Engine is safe for concurrent use by multiple goroutines.
 type Engine struct {
-	ins []instruction // the instruction stream
+	ins     []instruction // the instruction stream
+	origins []origin      // where each instruction came from, for errors
+	nranges int           // how many range conditions need per-run state
+	sep     string        // the line separator
+	ending  LineEnding    // how to end lines in the output
+	limits  limits        // how big things are allowed to get
 }
 
 // vm is the virtual machine state for a running sed program.
 type vm struct {
-	nxtl     string        // the next line
-	pat      string        // the pattern space, possibly nil
-	hold     string        // the hold buffer,   possibly nil
-	appl     *string       // any lines we've been asked to 'a\'ppend, usually nil
-	overflow string        // any overflow we might have accumulated
-	lastl    bool          // true if it's the last line
-	ins      []instruction // the instruction stream
-	ip       int           // the current locaiton in the instruction stream
-	input    *bufio.Reader // the input stream
-	output   []byte        // the output buffer
-	lineno   int           // current line number
-	modified bool          // have we modified the pattern space?
+	nxtl      string         // the next line
+	nxtnl     bool           // did the next line end in a separator?
+	patnl     bool           // did the current line end in a separator?
+	missingnl bool           // did we leave a separator off the output?
+	sep       string         // the line separator, usually "\n"
+	ending    LineEnding     // how to end lines in the output
+	nxtcr     bool           // did the next line end in "\r\n"?
+	patcr     bool           // did the current line end in "\r\n"?
+	joincr    []bool         // did each line 'N' joined end in "\r\n"?
+	pat       string         // the pattern space, possibly nil
+	hold      string         // the hold buffer,   possibly nil
+	appl      *string        // any lines we've been asked to 'a\'ppend, usually nil
+	overflow  string         // any overflow we might have accumulated
+	lastl     bool           // true if it's the last line
+	ins       []instruction  // the instruction stream
+	origins   []origin       // where each instruction came from, for errors
+	limits    limits         // how big things are allowed to get
+	ip        int            // the current locaiton in the instruction stream
+	input     *bufio.Reader  // the input stream
+	output    []byte         // the output buffer
+	lineno    int            // current line number
+	modified  bool           // have we modified the pattern space?
+	ranges    []rangeState   // the on/off state of each range condition
+	lastRE    *regexp.Regexp // the last regexp used, for the empty regexp //
+	filename  string         // the name of the current line's input, for 'F'
+	nxtname   string         // the name of the next line's input
+	inputs    []Input        // the inputs still to be read after this one
+	skipped   InputErrors    // the inputs that couldn't be read
+
+	rfiles    map[string]*bufio.Reader // files being read by 'R' commands
+	openFiles []io.Closer              // files to close when the run is over
+
+	ctx   context.Context // stops the run when it is done, possibly nil
+	steps int             // instructions run, for checking ctx now and then
+
+	countedLine int // the input line that lineSteps are counted for
+	lineSteps   int // instructions run for that line, for the limit
+	written     int // bytes of output so far, for the limit
 }
 
 // a sed instruction is mostly a function transforming an engine
 type instruction func(*vm) error
 
-// makeEngine is the logic behine the New and NewQuiet public functions.
-// It lexes and parses the program, and makes a new Engine out of it.
-func makeEngine(program io.Reader, isQuiet bool) (*Engine, error) {
-	bufprog := bufio.NewReader(program)
+// config holds the compile-time settings for an Engine.
+type config struct {
+	quiet     bool       // don't print the pattern space by default (-n)
+	dialect   Dialect    // the regexp syntax of the program
+	allowExec bool       // may the program run shell commands?
+	sandbox   bool       // reject commands that touch files or run commands
+	readOnly  bool       // reject commands that write files or run commands
+	fsys      fs.FS      // where 'r' and 'R' read files from, nil for the OS
+	sep       string     // the line separator
+	ending    LineEnding // how to end lines in the output
+	limits    limits     // how big things are allowed to get
+}
+
+// limits are the sizes that a running program may not exceed.
+// Zero means there is no limit.
+type limits struct {
+	patternSpace int // bytes in the pattern space
+	holdSpace    int // bytes in the hold space
+	appended     int // bytes of text waiting to be appended
+	instructions int // instructions run for one line of input
+	output       int // bytes of output for the whole run
+}
+
+// An Option adjusts how Compile (or New, or NewQuiet) builds an
+// Engine.  Since options are just values, a program that reads its
+// settings from a config file can collect the options it needs
+// into a slice, and hand them all to Compile.
+type Option func(*config)
+
+// Quiet keeps the engine from printing the pattern space at the end
+// of each cycle, like the -n switch of a UNIX sed.
+func Quiet() Option {
+	return func(c *config) {
+		c.quiet = true
+	}
+}
+
+// Sandbox keeps the program away from the rest of the system.  The
+// commands that read or write files ('r', 'R', 'w' and 'W'), the 'w'
+// modifier of 's', and the commands that run shell commands ('e' and
+// the 'e' modifier of 's') are all rejected when the program is
+// compiled, even with AllowExec.
+func Sandbox() Option {
+	return func(c *config) {
+		c.sandbox = true
+	}
+}
+
+// ReadOnly is a milder Sandbox, which only rejects the commands that
+// change things outside of the engine: 'w', 'W', 'e', and the 'w' and
+// 'e' modifiers of 's'.  The 'r' and 'R' commands can still read their
+// files, so the program's output is what it would be without ReadOnly.
+func ReadOnly() Option {
+	return func(c *config) {
+		c.readOnly = true
+	}
+}
+
+// WithFS makes the 'r' and 'R' commands read their files from fsys,
+// rather than from the operating system.  The names in the program
+// are then paths within fsys, like "data/words.txt".
+func WithFS(fsys fs.FS) Option {
+	return func(c *config) {
+		c.fsys = fsys
+	}
+}
+
+// MaxPatternSpace limits the pattern space to n bytes.  A program
+// that grows it any bigger, with 'N' or 'G' for instance, fails
+// with a *LimitError.
+func MaxPatternSpace(n int) Option {
+	return func(c *config) {
+		c.limits.patternSpace = n
+	}
+}
+
+// MaxHoldSpace limits the hold space to n bytes, against
+// programs that pile up lines in it with 'H'.
+func MaxHoldSpace(n int) Option {
+	return func(c *config) {
+		c.limits.holdSpace = n
+	}
+}
+
+// MaxAppendText limits the text waiting to be printed at the end
+// of a cycle, from the 'a', 'r' and 'R' commands, to n bytes.
+func MaxAppendText(n int) Option {
+	return func(c *config) {
+		c.limits.appended = n
+	}
+}
+
+// MaxInstructionsPerLine limits how many instructions the program
+// may run for each line of input, so that a loop like ':a;ba'
+// fails instead of running forever.
+func MaxInstructionsPerLine(n int) Option {
+	return func(c *config) {
+		c.limits.instructions = n
+	}
+}
+
+// MaxOutput limits the output of a whole run to n bytes.  The
+// write that would go past it fails, and puts out nothing.
+func MaxOutput(n int) Option {
+	return func(c *config) {
+		c.limits.output = n
+	}
+}
+
+// WithDialect selects the regular expression syntax of the
+// program.  The default is GoRE.
+func WithDialect(d Dialect) Option {
+	return func(c *config) {
+		c.dialect = d
+	}
+}
+
+// AllowExec lets the program run shell commands, via the 'e'
+// flag of the 's' command.  Without it, such programs won't compile.
+func AllowExec() Option {
+	return func(c *config) {
+		c.allowExec = true
+	}
+}
+
+// LineSeparator sets the string that separates the lines of the
+// input and output, instead of "\n".  The 'N', 'G' and 'H' commands
+// join lines with it, 'D' and 'P' look for it, and '$' is the last
+// line before the end of the input.  LineSeparator("\x00") is the
+// same as the -z switch of GNU sed.
+func LineSeparator(sep string) Option {
+	return func(c *config) {
+		c.sep = sep
+	}
+}
+
+// LineEnding says how an Engine should end the lines that it
+// writes, when lines are separated by newlines.  Either way, a
+// "\r\n" on input never makes it into the pattern space.
+type LineEnding int
+
+const (
+	// PreserveEndings ends each line the way its input
+	// line ended, with "\n" or "\r\n".  It is the default.
+	PreserveEndings LineEnding = iota
+
+	// LFEndings ends every line with "\n".
+	LFEndings
+
+	// CRLFEndings ends every line with "\r\n".
+	CRLFEndings
+)
+
+// WithLineEnding sets how the lines of the output end.
+func WithLineEnding(e LineEnding) Option {
+	return func(c *config) {
+		c.ending = e
+	}
+}
+
+// makeEngine is the logic behind the Compile, New and NewQuiet public
+// functions.  It lexes and parses the program, and makes a new Engine
+// out of it.
+func makeEngine(program io.Reader, opts []Option) (*Engine, error) {
+	cfg := config{sep: "\n"}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if len(cfg.sep) == 0 {
+		return nil, errors.New("the line separator can't be empty")
+	}
+	if l := cfg.limits; l.patternSpace < 0 || l.holdSpace < 0 || l.appended < 0 || l.instructions < 0 || l.output < 0 {
+		return nil, errors.New("the limits can't be negative")
+	}
+
+	parts := []Input{{Reader: program}}
+	if script, ok := program.(*Script); ok && script.rdr == nil && len(script.parts) > 0 {
+		parts = append([]Input(nil), script.parts...)
+	}
+
+	// as in POSIX, a program whose first line is "#n" is quiet
+	first := bufio.NewReader(parts[0].Reader)
+	if peek, _ := first.Peek(3); string(peek) == "#n\n" || string(peek) == "#n" {
+		cfg.quiet = true
+	}
+	parts[0].Reader = first
+
+	// keep a copy of the program text, to show with any errors
+	sources := make([]bytes.Buffer, len(parts))
+	for idx := range parts {
+		parts[idx].Reader = io.TeeReader(parts[idx].Reader, &sources[idx])
+	}
+
 	ch := make(chan *token, 128)
-	errch := make(chan error, 1)
-	go lex(bufprog, ch, errch)
+	go lex(parts, ch)
 
-	instructions, parseErr := parse(ch, isQuiet)
-	var err = <-errch // look for lexing errors first...
-	if err == nil {
-		// if there were no lex errors, look for a parsing error
-		err = parseErr
+	engine, err := parse(ch, &cfg)
+	if errs, ok := err.(SyntaxErrors); ok {
+		texts := make([]string, len(sources))
+		for idx := range sources {
+			texts[idx] = sources[idx].String()
+		}
+		errs.fillText(texts)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return &Engine{ins: instructions}, err
+	engine.limits = cfg.limits
+	return engine, nil
+}
+
+// Compile creates a new sed engine from a program, adjusted by any
+// options.  If the program has any errors, the returned engine will be
+// nil and the error will say what went wrong.  Mistakes in the program
+// come back as SyntaxErrors, which list every problem found along with
+// its location.
+func Compile(program io.Reader, opts ...Option) (*Engine, error) {
+	return makeEngine(program, opts)
 }
 
 // New creates a new sed engine from a program.  The program is executed
 // via the Run method. If the provided program has any errors, the returned
 // engine will be 'nil' and the error will be returned.  Otherwise, the returned
-// error will be nil.
-func New(program io.Reader) (*Engine, error) {
-	return makeEngine(program, false)
+// error will be nil.  Mistakes in the program come back as SyntaxErrors, which
+// list every problem found along with its location.
+func New(program io.Reader, opts ...Option) (*Engine, error) {
+	return makeEngine(program, opts)
 }
 
 // NewQuiet creates a new sed engine from a program.  It behaves exactly as
 // New(), except it produces an engine that doesn't print lines by defualt. This
 // is the classic '-n' sed behaviour.
-func NewQuiet(program io.Reader) (*Engine, error) {
-	return makeEngine(program, true)
+func NewQuiet(program io.Reader, opts ...Option) (*Engine, error) {
+	return makeEngine(program, append([]Option{Quiet()}, opts...))
 }
 
 // Wrap supplies an io.Reader that applies the sed Engine to the given
 // input.  The sed program is run lazily against the input as the user
 // asks for bytes.  If you'd prefer to run all at once from string to
-// string, use RunString instead.
+// string, use RunString instead.  Every wrapped reader gets its own
+// pattern space, hold space and range state, so it is fine to call
+// Wrap many times on the same Engine, even from different goroutines.
 func (e *Engine) Wrap(input io.Reader) io.Reader {
-	bufin := bufio.NewReader(input)
+	return e.WrapAll(Input{Name: "-", Reader: input})
+}
+
+// Input is one named source of input for WrapAll, or one
+// piece of a Script.
+type Input struct {
+	Name   string    // the name the 'F' command prints, "-" for stdin
+	Reader io.Reader // the input itself
+}
+
+// Script is a sed program put together from named pieces, the
+// way a command-line sed builds its program from all of the -e and
+// -f arguments.  The pieces are joined by newlines.  When a Script
+// is given to New or NewQuiet, any errors say which piece they
+// are in, and the line numbers count from the start of that piece.
+type Script struct {
+	parts []Input
+	rdr   io.Reader // the joined pieces, once the Script has been Read
+}
+
+// NewScript makes a Script out of its pieces.
+func NewScript(parts ...Input) *Script {
+	return &Script{parts: parts}
+}
 
+// Read gives the text of all the pieces of the Script, joined
+// by newlines, so that a Script works like any other io.Reader.
+func (s *Script) Read(p []byte) (int, error) {
+	if s.rdr == nil {
+		var rdrs []io.Reader
+		for idx, part := range s.parts {
+			if idx > 0 {
+				rdrs = append(rdrs, strings.NewReader("\n"))
+			}
+			rdrs = append(rdrs, part.Reader)
+		}
+		s.rdr = io.MultiReader(rdrs...)
+	}
+	return s.rdr.Read(p)
+}
+
+// WrapAll is like Wrap, but the inputs are treated as one continuous
+// stream, the way a UNIX sed treats the files on its command line:
+// line numbers keep counting from one input to the next, '$' is only
+// the last line of the last input, and the hold space carries over.
+// A 'q' stops the whole stream.
+func (e *Engine) WrapAll(inputs ...Input) io.Reader {
+	return e.wrapAll(nil, inputs)
+}
+
+// WrapContext is like Wrap, but the run stops when ctx is done.  The
+// output produced up to that point can still be read, and then the
+// reader gives back ctx.Err().  The context is checked as the program
+// runs, so a program stuck in a loop like ':a;s/x/xx/;ta' still stops,
+// and so does one waiting on an input that never delivers.
+func (e *Engine) WrapContext(ctx context.Context, input io.Reader) io.Reader {
+	return e.wrapAll(ctx, []Input{{Name: "-", Reader: &ctxReader{ctx: ctx, r: input}}})
+}
+
+func (e *Engine) wrapAll(ctx context.Context, inputs []Input) io.Reader {
 	// prime the engine by resetting the internal flags and filling nxtl...
-	return &vm{ins: e.ins, input: bufin, lineno: -1, ip: -1}
+	v := &vm{ins: e.ins, origins: e.origins, limits: e.limits, lineno: -1, ip: -1, ranges: make([]rangeState, e.nranges), sep: e.sep, ending: e.ending}
+	v.input = bufio.NewReader(strings.NewReader(""))
+	v.filename = "-"
+	v.nxtname = "-"
+	v.inputs = inputs
+	v.ctx = ctx
+	return v
+}
+
+// ctxReader is an io.Reader that gives up when its context is done,
+// even if the Read underneath it is stuck.  The stuck Read is left to
+// finish in its own goroutine, into a buffer nobody else sees.
+type ctxReader struct {
+	ctx     context.Context
+	r       io.Reader
+	pending chan ctxRead // the Read in progress, or nil
+	rest    []byte       // what's left of the last Read
+	err     error        // the error from the last Read
+}
+
+type ctxRead struct {
+	data []byte
+	err  error
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(cr.rest) == 0 && cr.err == nil {
+		if cr.pending == nil {
+			ch := make(chan ctxRead, 1)
+			buf := make([]byte, len(p))
+			go func() {
+				n, err := cr.r.Read(buf)
+				ch <- ctxRead{buf[:n], err}
+			}()
+			cr.pending = ch
+		}
+		select {
+		case res := <-cr.pending:
+			cr.pending = nil
+			cr.rest, cr.err = res.data, res.err
+		case <-cr.ctx.Done():
+			return 0, cr.ctx.Err()
+		}
+	}
+	n := copy(p, cr.rest)
+	cr.rest = cr.rest[n:]
+	if len(cr.rest) == 0 {
+		err := cr.err
+		cr.err = nil
+		return n, err
+	}
+	return n, nil
+}
+
+// ExitError is the error a program gives when it ends with
+// a non-zero exit code, as in 'q 5' or 'Q 5'.  All of the output
+// up to that point is still available, as with io.EOF.
+type ExitError struct {
+	Code int // the exit code given to 'q' or 'Q'
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("sed: exit status %d", e.Code)
+}
+
+var errNoPreviousRegexp = errors.New("no previous regular expression")
+
+// useRegexp notes that re is being used, so that a later empty
+// regexp (nil here) can refer back to it.  It returns the
+// regexp that should actually be used.
+func (v *vm) useRegexp(re *regexp.Regexp) (*regexp.Regexp, error) {
+	if re == nil {
+		if v.lastRE == nil {
+			return nil, errNoPreviousRegexp
+		}
+		return v.lastRE, nil
+	}
+	v.lastRE = re
+	return re, nil
 }
 
 // Read turns a vm into an io.Reader.
@@ -97,37 +486,157 @@ func (v *vm) Read(p []byte) (int, error) {
 
 	if v.lineno == -1 {
 		// we have an uninitialized stream
-		err = cmd_fillNext(v)
+		err = v.runtimeError(0, cmd_fillNext(v))
 		v.ip = 0
 	} else if len(v.overflow) > 0 {
 		// we have overflow to work on
 		o := v.overflow
 		v.overflow = ""
-		err = writeString(v, o)
+		err = writeRaw(v, o)
+	}
+	if err == nil && v.ctx != nil {
+		err = v.ctx.Err()
 	}
 
 	// run the program
 	for err == nil {
-		err = v.ins[v.ip](v)
+		ip := v.ip
+		err = v.ins[ip](v)
+		if err == nil {
+			err = v.checkLimits()
+		}
+		if err == nil && v.ctx != nil {
+			err = v.checkContext()
+		}
+		err = v.runtimeError(ip, err)
 	}
 
 	var n int = len(p) - len(v.output)
 
-	if ((err == fullBuffer) || (err == io.EOF)) && (n > 0) {
+	if err != nil && err != fullBuffer {
+		v.closeFiles()
+	}
+
+	// hold back the end of the stream until the output is read
+	_, quit := err.(*ExitError)
+	if ((err == fullBuffer) || (err == io.EOF) || quit || v.isCanceled(err)) && (n > 0) {
 		err = nil
 	}
 
+	// the skipped inputs are reported after everything else
+	if err == io.EOF && len(v.skipped) > 0 {
+		err = v.skipped
+	}
+
 	return n, err
 }
 
+// runtimeError wraps an error from the instruction at ip in a
+// RuntimeError.  The errors that just control the flow of the
+// program, like io.EOF, are left alone.
+func (v *vm) runtimeError(ip int, err error) error {
+	if err == nil || err == io.EOF || err == fullBuffer || v.isCanceled(err) {
+		return err
+	}
+	if _, quit := err.(*ExitError); quit {
+		return err
+	}
+	if _, input := err.(*InputError); input {
+		return err // it names its own input
+	}
+
+	re := &RuntimeError{Input: v.filename, InputLine: v.lineno, Err: err}
+	if ip >= 0 && ip < len(v.origins) {
+		org := v.origins[ip]
+		re.Command = org.letter
+		re.Source = org.name
+		re.Line = org.line
+		re.Column = org.pos
+	}
+	return re
+}
+
+// checkLimits makes sure the program hasn't grown anything
+// past its limits.  The output limit is checked as the output
+// is written, in writeString.
+func (v *vm) checkLimits() error {
+	if v.limits.patternSpace > 0 && len(v.pat) > v.limits.patternSpace {
+		return &LimitError{Limit: "pattern space", Max: v.limits.patternSpace, Unit: "bytes"}
+	}
+	if v.limits.holdSpace > 0 && len(v.hold) > v.limits.holdSpace {
+		return &LimitError{Limit: "hold space", Max: v.limits.holdSpace, Unit: "bytes"}
+	}
+	if v.limits.appended > 0 && v.appl != nil && len(*v.appl) > v.limits.appended {
+		return &LimitError{Limit: "appended text", Max: v.limits.appended, Unit: "bytes"}
+	}
+	if v.limits.instructions > 0 {
+		if v.lineno != v.countedLine {
+			v.countedLine = v.lineno
+			v.lineSteps = 0
+		}
+		v.lineSteps++
+		if v.lineSteps > v.limits.instructions {
+			return &LimitError{Limit: "instruction count", Max: v.limits.instructions, Unit: "instructions"}
+		}
+	}
+	return nil
+}
+
+// checkContext looks at the context every so often, since
+// looking on every instruction would slow the run down.
+func (v *vm) checkContext() error {
+	v.steps++
+	if v.steps%256 != 0 {
+		return nil
+	}
+	select {
+	case <-v.ctx.Done():
+		return v.ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// isCanceled is true when err is the error from the run's context.
+func (v *vm) isCanceled(err error) bool {
+	return v.ctx != nil && err != nil && err == v.ctx.Err()
+}
+
+// closeFiles closes any files opened during the run.
+func (v *vm) closeFiles() {
+	for _, f := range v.openFiles {
+		f.Close()
+	}
+	v.openFiles = nil
+	v.rfiles = nil
+}
+
 // RunString executes the program embodied by the Engine on the
 // given string as input, returning the output string and any
-// errors that occured.
+// errors that occured.  When the program quits with a non-zero
+// exit code, the output is returned along with an *ExitError.
 func (e *Engine) RunString(input string) (string, error) {
+	return e.runString(nil, input)
+}
+
+// RunStringContext is like RunString, but stops when ctx is done.
+// Whatever output the program made before then is returned, along
+// with ctx.Err().
+func (e *Engine) RunStringContext(ctx context.Context, input string) (string, error) {
+	return e.runString(ctx, input)
+}
+
+func (e *Engine) runString(ctx context.Context, input string) (string, error) {
 	inbuf := strings.NewReader(input)
 	var outbytes bytes.Buffer
 
-	_, err := io.Copy(&outbytes, e.Wrap(inbuf))
+	var rdr io.Reader
+	if ctx == nil {
+		rdr = e.Wrap(inbuf)
+	} else {
+		rdr = e.WrapContext(ctx, inbuf)
+	}
+	_, err := io.Copy(&outbytes, rdr)
 
 	if err == io.EOF {
 		err = nil
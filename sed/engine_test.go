@@ -1,14 +1,23 @@
 package sed
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
 )
 
 // a driver for running a program against input, and checking the output
-func runprog(t *testing.T, prog, input, expected string) {
-	engine, err := New(strings.NewReader(prog))
+func runprog(t *testing.T, prog, input, expected string, opts ...Option) {
+	engine, err := New(strings.NewReader(prog), opts...)
 	if err != nil {
 		t.Fatalf("Couldn't parse program <%s>, %s", prog, err.Error())
 	}
@@ -161,3 +170,629 @@ t loop
 		t.Fatalf("Incorrect Answer <%s> instead of 123,456", ans)
 	}
 }
+
+func TestRangeStateIsPerRun(t *testing.T) {
+	engine, err := New(strings.NewReader(`/start/,/end/d`))
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+
+	// leave the range open at the end of the first input...
+	result, err := engine.RunString("keep\nstart\ndrop\n")
+	if err != nil || result != "keep\n" {
+		t.Fatalf("First run got <%s> (err %v) instead of <keep\\n>", result, err)
+	}
+
+	// ... and make sure it doesn't leak into the next one
+	result, err = engine.RunString("keep\n")
+	if err != nil || result != "keep\n" {
+		t.Fatalf("Second run got <%s> (err %v) instead of <keep\\n>", result, err)
+	}
+}
+
+func TestConcurrentWrap(t *testing.T) {
+	engine, err := New(strings.NewReader(`2,/end/d`))
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+
+	const workers = 16
+	input := strings.Repeat("a\nb\nc\nend\nd\n", 50)
+	expected := "a\nd\n" + strings.Repeat("a\nb\nc\nend\nd\n", 49)
+
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			result, err := engine.RunString(input)
+			if err == nil && result != expected {
+				err = fmt.Errorf("got <%s>", result)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGNUAddresses(t *testing.T) {
+	input := "1\n2\n3\n4\n5\n6\n7\n8\n"
+
+	runprog(t, `0,/[0-9]/d`, input, "2\n3\n4\n5\n6\n7\n8\n")
+	runprog(t, `1,/[0-9]/d`, input, "3\n4\n5\n6\n7\n8\n")
+	runprog(t, `1~3d`, input, "2\n3\n5\n6\n8\n")
+	runprog(t, `0~4!d`, input, "4\n8\n")
+	runprog(t, `/2/,+2d`, input, "1\n5\n6\n7\n8\n")
+	runprog(t, `/2/,~4d`, input, "1\n5\n6\n7\n8\n")
+	runprog(t, `/4/,~4d`, input, "1\n2\n3\n5\n6\n7\n8\n")
+	runprog(t, `5,3d`, input, "1\n2\n3\n4\n6\n7\n8\n")
+	runprog(t, `2,4!d`, input, "2\n3\n4\n")
+
+	for _, bad := range []string{`0d`, `0,5d`, `1,+d`, `+3d`} {
+		if _, err := New(strings.NewReader(bad)); err == nil {
+			t.Errorf("Program <%s> should not have compiled", bad)
+		}
+	}
+}
+
+func TestBRE(t *testing.T) {
+	bre := WithDialect(BRE)
+	runprog(t, `s/a\(bc*\)d/\1/g`, "abccd ad abd\n", "bcc ad b\n", bre)
+	runprog(t, `s/x\{2,3\}/[&]/`, "xxxxx\n", "[xxx]xx\n", bre)
+	runprog(t, `s/a\{,3\}/X/`, "aaaaa\n", "Xaa\n", bre)
+	runprog(t, `s/(a|b)+/$&\&/`, "(a|b)+ and ab\n", "$(a|b)+& and ab\n", bre)
+	runprog(t, `s/^*a$b$/X/`, "*a$b\n", "X\n", bre)
+	runprog(t, `/[]x]/d`, "a]b\nxy\nplain\n", "plain\n", bre)
+	runprog(t, `/^[[:digit:]]\+$/d`, "123\n12a\n", "12a\n", bre)
+	runprog(t, `N;s/a.b/X/`, "a\nb\n", "X\n", bre)
+
+	// an escaped delimiter is the plain character, as in GNU sed
+	runprog(t, `s|a\|b|X|`, "a|b ab\n", "X ab\n", bre)
+	runprog(t, `s+a\+b+P+`, "aab a+b\n", "aab P\n", bre)
+	runprog(t, `\|a\|b|d`, "a|b\nab\n", "ab\n", bre)
+
+	for _, bad := range []string{`s/a\{\}/X/`, `s/a\{1,2,3\}/X/`, `s/a\{x\}/X/`} {
+		if _, err := New(strings.NewReader(bad), bre); err == nil {
+			t.Errorf("Program <%s> should not have compiled", bad)
+		}
+	}
+}
+
+func TestERE(t *testing.T) {
+	ere := WithDialect(ERE)
+	runprog(t, `s/a(bc*)d/\1/g`, "abccd ad abd\n", "bcc ad b\n", ere)
+	runprog(t, `s/(cat|dog)s?/<&>/g`, "cats and dog\n", "<cats> and <dog>\n", ere)
+	runprog(t, `s/\(x\)/$1/`, "a(x)b\n", "a$1b\n", ere)
+	runprog(t, `s/a{,3}/X/`, "aaaaa\n", "Xaa\n", ere)
+	runprog(t, `s/a{2}/X/g`, "aaaaa\n", "XXa\n", ere)
+	runprog(t, `s/a{x}/X/`, "a{x}\n", "X\n", ere)
+
+	// POSIX matching is leftmost-longest
+	runprog(t, `s/a|ab/X/`, "abc\n", "Xc\n", ere)
+
+	// an escaped delimiter is the plain character, as in GNU sed
+	runprog(t, `s|a\|b|X|g`, "ab|c\n", "XX|c\n", ere)
+	runprog(t, `s+a\+b+P+`, "aab a+b\n", "P a+b\n", ere)
+	runprog(t, `\|a\|b|d`, "a\nc\nb\n", "c\n", ere)
+
+	for _, bad := range []string{`/(a)\1/d`, `s/\<a/b/`, `s/a{}/X/`, `s/a{1,2,3}/X/`} {
+		if _, err := New(strings.NewReader(bad), ere); err == nil {
+			t.Errorf("Program <%s> should not have compiled", bad)
+		}
+	}
+}
+
+func TestCaseConversion(t *testing.T) {
+	runprog(t, `s/\w+/\u$0/g`, "hello big world\n", "Hello Big World\n")
+	runprog(t, `s/(\w+) (\w+)/\U$1\E $2/`, "hello world\n", "HELLO world\n")
+	runprog(t, `s/.*/\L\u$0/`, "hELLO wORLD\n", "Hello world\n")
+	runprog(t, `s/(?P<first>\w)(\w*)/\l${first}\U${2}x/`, "Abc\n", "aBCX\n")
+	runprog(t, `s/.*/\U$0/`, "grün ωμέγα\n", "GRÜN ΩΜΈΓΑ\n")
+	runprog(t, `s/\w+/\\$$0/`, "money\n", "\\$0\n")
+	runprog(t, `s/\(\w\+\)/\u&-\U\1/`, "camel\n", "Camel-CAMEL\n", WithDialect(BRE))
+}
+
+func TestSubstFlags(t *testing.T) {
+	runprog(t, `s/hello/bye/I`, "HeLLo there\n", "bye there\n")
+	runprog(t, `N;s/^b/B/gM`, "a\nb\n", "a\nB\n")
+	runprog(t, `N;s/^b/B/g`, "a\nb\n", "a\nb\n")
+
+	dir, err := ioutil.TempDir("", "sedtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wfile := filepath.Join(dir, "changed.txt")
+	runprog(t, "s/a/A/gw "+wfile, "abc\nxyz\nbanana\n", "Abc\nxyz\nbAnAnA\n")
+	written, err := ioutil.ReadFile(wfile)
+	if err != nil || string(written) != "Abc\nbAnAnA\n" {
+		t.Fatalf("w modifier wrote <%s> (err %v)", written, err)
+	}
+
+	runprog(t, `s/.*/echo $0 | tr a-z A-Z/e`, "hello\n", "HELLO\n", AllowExec())
+	if _, err := New(strings.NewReader(`s/x/date/e`)); err == nil {
+		t.Fatalf("the 'e' modifier should need AllowExec")
+	}
+}
+
+func TestAddressFlags(t *testing.T) {
+	runprog(t, `/error/Id`, "Error one\nfine\nERROR two\n", "fine\n")
+	runprog(t, `\%/usr/local%d`, "/usr/local/bin\n/usr/bin\n", "/usr/bin\n")
+	runprog(t, `\,a\,b,d`, "a,b\nab\n", "ab\n")
+	runprog(t, `/start/I,\#END#Id`, "a\nSTART\nb\nend\nc\n", "a\nc\n")
+	runprog(t, `N;/^b$/Ms/^/>/M`, "a\nb\n", ">a\nb\n")
+	runprog(t, `/x/Ip`, "X\n", "X\nX\n")
+}
+
+func TestEmptyRegexp(t *testing.T) {
+	runprog(t, `/foo+/s//bar/`, "a foooo b\nno\n", "a bar b\nno\n")
+	runprog(t, `s/(a+)b/x/;s//[$1]/`, "aab aaab\n", "x [aaa]\n")
+	runprog(t, `/x/b;/y/b;//d`, "x\ny\nz\n", "x\ny\nz\n")
+	runprog(t, `/a/,//d`, "1\na\n2\na\n3\n", "1\n3\n")
+
+	engine, err := New(strings.NewReader(`s//x/`))
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+	if _, err = engine.RunString("line\n"); !errors.Is(err, errNoPreviousRegexp) {
+		t.Fatalf("Expected an error about no previous regexp, got %v", err)
+	}
+}
+
+func TestGNUCommands(t *testing.T) {
+	runprog(t, `n;l`, "a\nb\\c\td\x01é\n", "a\nb\\\\c\\td\\001é$\nb\\c\td\x01é\n")
+	runprog(t, `l 5`, "abcdefgh\n", "abcd\\\nefgh$\nabcdefgh\n")
+	runprog(t, `F`, "a\n", "-\na\n")
+	runprog(t, `/b/z`, "a\nb\nc\n", "a\n\nc\n")
+	runprog(t, `2Q`, "a\nb\nc\n", "a\n")
+	runprog(t, `2q`, "a\nb\nc\n", "a\nb\n")
+	runprog(t, `a\
+after
+2q`, "a\nb\nc\n", "a\nafter\nb\nafter\n")
+	runprog(t, `s/x/y/;T;s/$/!/`, "x\nz\n", "y!\nz\n")
+	runprog(t, `s/x/y/;Tskip;s/$/!/;:skip`, "x\nz\n", "y!\nz\n")
+	runprog(t, `v 4.2
+N;W /dev/stdout
+d`, "a\nb\n", "a\n")
+	runprog(t, `e echo hi`, "a\n", "hi\na\n", AllowExec())
+	runprog(t, `1e`, "echo hello\n", "hello\n", AllowExec())
+
+	dir, err := ioutil.TempDir("", "sedtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rfile := filepath.Join(dir, "lines.txt")
+	if err = ioutil.WriteFile(rfile, []byte("one\ntwo"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := New(strings.NewReader("R " + rfile))
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+	for i := 0; i < 2; i++ {
+		// each run reads the file from the start
+		result, err := engine.RunString("a\nb\nc\n")
+		if err != nil || result != "a\none\nb\ntwo\nc\n" {
+			t.Fatalf("R command gave <%s> (err %v)", result, err)
+		}
+	}
+
+	for _, bad := range []string{`v 5.0`, `e ls`} {
+		if _, err := New(strings.NewReader(bad)); err == nil {
+			t.Errorf("Program <%s> should not have compiled", bad)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	engine, err := New(strings.NewReader(`/FORBIDDEN/q 3`))
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+
+	result, err := engine.RunString("ok\nFORBIDDEN\nnever\n")
+	exitErr, ok := err.(*ExitError)
+	if !ok || exitErr.Code != 3 {
+		t.Fatalf("Expected exit code 3, got %v", err)
+	}
+	if result != "ok\nFORBIDDEN\n" {
+		t.Fatalf("Got <%s> before quitting", result)
+	}
+
+	// no exit code means a normal end
+	runprog(t, `2q0`, "a\nb\nc\n", "a\nb\n")
+	runprog(t, `2Q 0`, "a\nb\nc\n", "a\n")
+}
+
+func TestMissingFinalNewline(t *testing.T) {
+	runprog(t, ``, "a\nb", "a\nb")
+	runprog(t, `p`, "a\nb", "a\na\nb\nb")
+	runprog(t, `$a\
+end`, "a\nb", "a\nb\nend\n")
+	runprog(t, `N;P;D`, "a\nb\nc", "a\nb\nc")
+	runprog(t, `$!d`, "a\n\n", "\n")
+	runprog(t, `s/b/B/`, "", "")
+}
+
+func TestLineSeparator(t *testing.T) {
+	nul := LineSeparator("\x00")
+	runprog(t, `s/^/>/`, "a\nb\x00c\x00", ">a\nb\x00>c\x00", nul)
+	runprog(t, `$!N;P;D`, "a\x00b\x00c", "a\x00b\x00c", nul)
+	runprog(t, `1h;2G;2!d`, "x\x00y\x00", "y\x00x\x00", nul)
+	runprog(t, `$d`, "one\x00two\x00three\x00", "one\x00two\x00", nul)
+
+	runprog(t, `N;s/::/+/`, "a::b::c::", "a+b::c::", LineSeparator("::"))
+
+	if _, err := New(strings.NewReader(`p`), LineSeparator("")); err == nil {
+		t.Fatalf("an empty separator should be an error")
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	crlf := "one\r\ntwo\r\nthree\r\n"
+	runprog(t, `s/o$/O/`, crlf, "one\r\ntwO\r\nthree\r\n")
+	runprog(t, `2i\
+inserted`, crlf, "one\r\ninserted\r\ntwo\r\nthree\r\n")
+	runprog(t, `N;s/\n/+/`, "a\r\nb\nc\r\n", "a+b\nc\r\n")
+	runprog(t, ``, "a\r\nb\n", "a\nb\n", WithLineEnding(LFEndings))
+	runprog(t, `$!N`, "a\r\nb\nc", "a\r\nb\r\nc", WithLineEnding(CRLFEndings))
+	runprog(t, `=`, "a\n", "1\r\na\r\n", WithLineEnding(CRLFEndings))
+
+	// each line keeps its own ending, even when 'N' joins them
+	mixed := "a\r\nb\nc\r\nd\n"
+	runprog(t, `$!N;P;D`, mixed, mixed)
+	runprog(t, `N`, mixed, mixed)
+	runprog(t, `$!N;s/^/>/mg`, mixed, ">a\r\n>b\n>c\r\n>d\n")
+}
+
+func TestWrapAll(t *testing.T) {
+	engine, err := New(strings.NewReader(`=;F;1h;$G`))
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+
+	all := engine.WrapAll(
+		Input{Name: "one", Reader: strings.NewReader("a\nb\n")},
+		Input{Name: "empty", Reader: strings.NewReader("")},
+		Input{Name: "two", Reader: strings.NewReader("c")},
+		Input{Name: "three", Reader: strings.NewReader("d\n")},
+	)
+	result, err := ioutil.ReadAll(all)
+	expected := "1\none\na\n2\none\nb\n3\ntwo\nc\n4\nthree\nd\na\n"
+	if err != nil || string(result) != expected {
+		t.Fatalf("got <%s>, %v; expected <%s>", result, err, expected)
+	}
+
+	quit, err := New(strings.NewReader(`2q`))
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+	result, err = ioutil.ReadAll(quit.WrapAll(
+		Input{Name: "one", Reader: strings.NewReader("a\n")},
+		Input{Name: "two", Reader: strings.NewReader("b\nc\n")},
+	))
+	if err != nil || string(result) != "a\nb\n" {
+		t.Fatalf("got <%s>, %v from a quit across inputs", result, err)
+	}
+
+	// an input that can't be read is skipped, and reported at the end
+	missing := errors.New("no such file")
+	result, err = ioutil.ReadAll(engine.WrapAll(
+		Input{Name: "one", Reader: strings.NewReader("a\nb")},
+		Input{Name: "missing", Reader: iotest.ErrReader(missing)},
+		Input{Name: "two", Reader: strings.NewReader("c\n")},
+	))
+	expected = "1\none\na\n2\none\nb\n3\ntwo\nc\na\n"
+	var ies InputErrors
+	if string(result) != expected || !errors.As(err, &ies) || len(ies) != 1 || ies[0].Input != "missing" || !errors.Is(err, missing) {
+		t.Fatalf("got <%s>, %v; expected <%s> and missing to be skipped", result, err, expected)
+	}
+
+	// an input that fails partway stops the run, and is named
+	broken := errors.New("disk on fire")
+	result, err = ioutil.ReadAll(engine.WrapAll(
+		Input{Name: "one", Reader: strings.NewReader("a\n")},
+		Input{Name: "broken", Reader: io.MultiReader(strings.NewReader("b\nc"), iotest.ErrReader(broken))},
+	))
+	var ie *InputError
+	if !errors.As(err, &ie) || ie.Input != "broken" || !errors.Is(err, broken) {
+		t.Fatalf("got <%s>, %v; expected broken to fail", result, err)
+	}
+}
+
+func TestScript(t *testing.T) {
+	script := NewScript(
+		Input{Name: "one", Reader: strings.NewReader(`s/a/A/`)},
+		Input{Name: "two", Reader: strings.NewReader("a\\")},
+		Input{Name: "three", Reader: strings.NewReader(`appended`)},
+	)
+	engine, err := New(script)
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+	result, err := engine.RunString("abc\n")
+	if err != nil || result != "Abc\nappended\n" {
+		t.Fatalf("got <%s>, %v", result, err)
+	}
+
+	_, err = New(NewScript(
+		Input{Name: "good", Reader: strings.NewReader("p\np")},
+		Input{Name: "bad", Reader: strings.NewReader("p\n\n  k")},
+	))
+	if err == nil || !strings.HasSuffix(err.Error(), "at line 3, pos 3 of bad") {
+		t.Fatalf("wrong error for a bad command: %v", err)
+	}
+
+	// #n on the first line is the same as -n
+	runprog(t, "#n\n2p", "a\nb\nc\n", "b\n")
+	runprog(t, "#nope\n2p", "a\nb\n", "a\nb\nb\n")
+	engine, err = New(NewScript(
+		Input{Name: "first", Reader: strings.NewReader(`#n`)},
+		Input{Name: "second", Reader: strings.NewReader(`$p`)},
+	))
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+	if result, _ := engine.RunString("a\nb\n"); result != "b\n" {
+		t.Fatalf("got <%s> from a #n script", result)
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	_, err := New(NewScript(
+		Input{Name: "first", Reader: strings.NewReader("p\nb nowhere")},
+		Input{Name: "second", Reader: strings.NewReader("s/a/b/\n  k;/x(/d\n\t5p;y/ab/c/")},
+	))
+
+	var errs SyntaxErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected SyntaxErrors, got %v", err)
+	}
+	expected := []struct {
+		source       string
+		line, column int
+		token        string
+	}{
+		{"first", 2, 1, "b"},
+		{"second", 2, 3, "k"},
+		{"second", 2, 5, "/x(/"},
+		{"second", 3, 5, "y"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(errs), err)
+	}
+	for idx, e := range expected {
+		got := errs[idx]
+		if got.Source != e.source || got.Line != e.line || got.Column != e.column || got.Token != e.token {
+			t.Errorf("error %d: got %s:%d:%d <%s>, expected %s:%d:%d <%s>", idx,
+				got.Source, got.Line, got.Column, got.Token, e.source, e.line, e.column, e.token)
+		}
+	}
+
+	// the first error is there for errors.As, too
+	var first *SyntaxError
+	if !errors.As(err, &first) || first != errs[0] {
+		t.Fatalf("errors.As didn't find the first SyntaxError")
+	}
+
+	if snip := errs[1].Snippet(); snip != "   2 |   k;/x(/d\n     |   ^\n" {
+		t.Errorf("bad snippet <%s>", snip)
+	}
+	if snip := errs[3].Snippet(); snip != "   3 | \t5p;y/ab/c/\n     | \t   ^\n" {
+		t.Errorf("bad snippet <%s>", snip)
+	}
+
+	// lexing errors are syntax errors too
+	_, err = New(strings.NewReader("p\ns/a/"))
+	if !errors.As(err, &first) || first.Line != 2 || first.Column != 1 {
+		t.Fatalf("wrong error for an unfinished s command: %v", err)
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sedtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "no", "such", "dir")
+
+	engine, err := New(NewScript(
+		Input{Name: "script", Reader: strings.NewReader("p\n2,$ {\n  w " + missing + "\n}")},
+	))
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+	_, err = ioutil.ReadAll(engine.WrapAll(Input{Name: "data", Reader: strings.NewReader("a\nb\nc\n")}))
+
+	var re *RuntimeError
+	if !errors.As(err, &re) {
+		t.Fatalf("expected a RuntimeError, got %v", err)
+	}
+	if re.Command != 'w' || re.Source != "script" || re.Line != 3 || re.Column != 3 || re.Input != "data" || re.InputLine != 2 {
+		t.Fatalf("wrong details in %#v", re)
+	}
+	if !os.IsNotExist(errors.Unwrap(err)) {
+		t.Fatalf("expected the underlying error to be kept, got %v", re.Err)
+	}
+
+	// quitting isn't an error, and keeps its own type
+	engine, _ = New(strings.NewReader(`2q 4`))
+	_, err = engine.RunString("a\nb\nc\n")
+	if _, ok := err.(*ExitError); !ok {
+		t.Fatalf("expected a bare ExitError, got %v", err)
+	}
+}
+
+func TestCompileOptions(t *testing.T) {
+	runprog(t, `2p`, "a\nb\n", "b\n", Quiet())
+
+	// the sandbox keeps files and commands away from the program
+	for _, bad := range []string{`r x`, `w x`, `R x`, `W x`, `s/a/b/w x`, `e ls`, `s/a/ls/e`, "p\n  1e"} {
+		_, err := Compile(strings.NewReader(bad), Sandbox(), AllowExec())
+		var se *SyntaxError
+		if !errors.As(err, &se) || !strings.Contains(se.Msg, "sandbox") {
+			t.Errorf("Program <%s> should not have compiled in a sandbox: %v", bad, err)
+		}
+	}
+	runprog(t, `s/a/b/p;y/b/c/`, "a\n", "b\nc\n", Sandbox())
+
+	// the sandbox error points at the command, and the file is never opened
+	_, err := Compile(strings.NewReader("p\n  2r /no/such/file"), Sandbox())
+	var se *SyntaxError
+	if !errors.As(err, &se) || se.Line != 2 || se.Column != 4 || se.Token != "r" {
+		t.Errorf("expected a sandbox error at the 'r', got %#v", se)
+	}
+
+	// read-only programs can still read files, but not write them
+	for _, bad := range []string{`w x`, `W x`, `s/a/b/w x`, `e ls`, `s/a/ls/e`} {
+		_, err := Compile(strings.NewReader(bad), ReadOnly(), AllowExec())
+		var se *SyntaxError
+		if !errors.As(err, &se) || !strings.Contains(se.Msg, "read-only") {
+			t.Errorf("Program <%s> should not have compiled read-only: %v", bad, err)
+		}
+	}
+
+	// r and R read from the given file system
+	fsys := fstest.MapFS{"data/words.txt": {Data: []byte("one\ntwo\n")}}
+	runprog(t, `1r data/words.txt`, "a\nb\n", "a\none\ntwo\nb\n", WithFS(fsys))
+	runprog(t, `R data/words.txt`, "a\nb\nc\n", "a\none\nb\ntwo\nc\n", WithFS(fsys))
+	runprog(t, `1r data/words.txt`, "a\n", "a\none\ntwo\n", WithFS(fsys), ReadOnly())
+	if _, err := Compile(strings.NewReader(`r /etc/passwd`), WithFS(fsys)); err == nil {
+		t.Errorf("r should not find files outside of the FS")
+	}
+
+	// the pattern space can be kept small
+	limited := MaxPatternSpace(8)
+	runprog(t, `$!N`, "abc\ndef\n", "abc\ndef\n", limited)
+	engine, err := Compile(strings.NewReader(`:a;N;ba`), limited)
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+	_, err = engine.RunString("one\ntwo\nthree\nfour\n")
+	var le *LimitError
+	if !errors.As(err, &le) || le.Limit != "pattern space" || le.Max != 8 {
+		t.Fatalf("expected a pattern space LimitError, got %v", err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	// a loop that never reads more input still stops
+	engine, err := New(strings.NewReader(`p;:a;s/x/xx/;ta`))
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	out, err := engine.RunStringContext(ctx, "x\n")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to pass, got %v", err)
+	}
+	if out != "x\n" {
+		t.Errorf("expected the partial output <x\\n>, got <%s>", out)
+	}
+
+	// so does one waiting on input that never arrives
+	engine, err = New(strings.NewReader(`p`))
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("a\nb\nc"))
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	outb, err := ioutil.ReadAll(engine.WrapContext(ctx, pr))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to pass, got %v", err)
+	}
+	if string(outb) != "a\na\n" {
+		t.Errorf("expected the partial output <a\\na\\n>, got <%s>", outb)
+	}
+
+	// a context that is never done changes nothing
+	out, err = engine.RunStringContext(context.Background(), "a\n")
+	if err != nil || out != "a\na\n" {
+		t.Errorf("expected <a\\na\\n>, got <%s> and %v", out, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	// each of the limits, with a program that trips it
+	var tests = []struct {
+		prog  string
+		opt   Option
+		limit string
+		cmd   rune
+	}{
+		{`H`, MaxHoldSpace(10), "hold space", 'H'},
+		{`p;a\
+some appended text`, MaxAppendText(10), "appended text", 'a'},
+		{`:a;ba`, MaxInstructionsPerLine(100), "instruction count", 'b'},
+		{`p;p`, MaxOutput(18), "output", 'p'},
+		{`s/x/xxxxxxxxxx/g`, MaxPatternSpace(20), "pattern space", 's'},
+	}
+	for _, test := range tests {
+		engine, err := Compile(strings.NewReader(test.prog), test.opt)
+		if err != nil {
+			t.Fatalf("Couldn't parse program <%s>, %s", test.prog, err.Error())
+		}
+		_, err = engine.RunString("one\ntwo\nthree\nxxx\n")
+		var le *LimitError
+		var re *RuntimeError
+		if !errors.As(err, &le) || le.Limit != test.limit {
+			t.Errorf("Program <%s> should have gone past the %s limit: %v", test.prog, test.limit, err)
+		} else if !errors.As(err, &re) || re.Command != test.cmd {
+			t.Errorf("Program <%s> should have failed in '%c': %v", test.prog, test.cmd, err)
+		}
+	}
+
+	// staying under the limits is fine
+	runprog(t, `:a;s/x/y/;ta`, "xxx\nxx\n", "yyy\nyy\n", MaxInstructionsPerLine(20))
+	runprog(t, `p`, "ab\ncd\n", "ab\nab\ncd\ncd\n", MaxOutput(12))
+	runprog(t, `H;$!d;x`, "ab\ncd\n", "\nab\ncd\n", MaxHoldSpace(6))
+
+	// the output stops short of the limit
+	engine, err := Compile(strings.NewReader(`p`), MaxOutput(10))
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+	out, err := engine.RunString("ab\ncd\nef\n")
+	if out != "ab\nab\ncd\n" {
+		t.Errorf("expected the output before the limit, got <%s>", out)
+	}
+	var le *LimitError
+	if !errors.As(err, &le) || le.Error() != "the output is over its limit of 10 bytes" {
+		t.Errorf("expected an output LimitError, got %v", err)
+	}
+
+	// 'P' writes in two parts, and the first part isn't lost
+	engine, err = Compile(strings.NewReader(`$!N;P;D`), MaxOutput(5))
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+	out, err = engine.RunString("abcdefgh\nx\n")
+	var re *RuntimeError
+	if out != "" || !errors.As(err, &re) || re.Command != 'P' || !errors.As(err, &le) || le.Limit != "output" {
+		t.Errorf("expected no output and an output LimitError from 'P', got <%s> and %v", out, err)
+	}
+
+	// ... and neither is the first part of 'F'
+	engine, err = Compile(strings.NewReader(`F`), MaxOutput(5))
+	if err != nil {
+		t.Fatalf("Couldn't parse program, %s", err.Error())
+	}
+	outb, err := ioutil.ReadAll(engine.WrapAll(Input{Name: "longname", Reader: strings.NewReader("x\n")}))
+	if len(outb) != 0 || !errors.As(err, &re) || re.Command != 'F' {
+		t.Errorf("expected no output and an output LimitError from 'F', got <%s> and %v", outb, err)
+	}
+
+	if _, err := Compile(strings.NewReader(`p`), MaxOutput(-1)); err == nil {
+		t.Errorf("a negative limit should not be accepted")
+	}
+}
@@ -0,0 +1,215 @@
+package sed
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// SyntaxError is a problem found while compiling a sed program,
+// along with where it was found.
+type SyntaxError struct {
+	Source string // the piece of a Script it is in, or "" for a plain program
+	Line   int    // the line of the program, counting from 1
+	Column int    // the character on that line, counting from 1
+	Token  string // the text of the offending token, like "k" or "/re/"
+	Msg    string // what went wrong
+	Text   string // the whole line of the program, when it is known
+
+	part int // which piece of the program it is in, to find Text
+}
+
+func newSyntaxError(tok *token, msg string) *SyntaxError {
+	var se = &SyntaxError{Msg: msg}
+	if tok != nil {
+		se.Source = tok.name
+		se.Line = tok.line
+		se.Column = tok.pos
+		se.Token = tok.String()
+		se.part = tok.part
+	}
+	return se
+}
+
+func (e *SyntaxError) Error() string {
+	loc := location{name: e.Source, line: e.Line, pos: e.Column}
+	return fmt.Sprintf("%s %v", e.Msg, &loc)
+}
+
+// Snippet shows the line of the program with the error,
+// and a caret under the spot where it was found:
+//
+//	3 | s/a(/b/
+//	  | ^
+//
+// It is empty when the text of the line isn't known.
+func (e *SyntaxError) Snippet() string {
+	if e.Line < 1 || e.Text == "" {
+		return ""
+	}
+
+	// keep any tabs, so the caret lines up
+	var pad strings.Builder
+	for idx, r := range []rune(e.Text) {
+		if idx >= e.Column-1 {
+			break
+		}
+		if r == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+	}
+
+	num := fmt.Sprintf("%4d", e.Line)
+	return fmt.Sprintf("%s | %s\n%s | %s^\n", num, e.Text, strings.Repeat(" ", len(num)), pad.String())
+}
+
+// SyntaxErrors are all of the problems found in a sed program.
+// New and NewQuiet report every one they can find, rather than
+// stopping at the first.  The first one can also be had with
+// errors.As and a *SyntaxError.
+type SyntaxErrors []*SyntaxError
+
+func (es SyntaxErrors) Error() string {
+	msgs := make([]string, len(es))
+	for idx, e := range es {
+		msgs[idx] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap gives the first of the errors.
+func (es SyntaxErrors) Unwrap() error {
+	if len(es) == 0 {
+		return nil
+	}
+	return es[0]
+}
+
+// sortByPosition puts the errors in the order they appear in the
+// program, since some (like unknown labels) are found late.
+func (es SyntaxErrors) sortByPosition() {
+	sort.SliceStable(es, func(i, j int) bool {
+		a, b := es[i], es[j]
+		if a.part != b.part {
+			return a.part < b.part
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// fillText looks up the program text for each of the errors,
+// given the text of each piece of the program.
+func (es SyntaxErrors) fillText(sources []string) {
+	for _, e := range es {
+		if e.part < 0 || e.part >= len(sources) || e.Line < 1 {
+			continue
+		}
+		lines := strings.Split(sources[e.part], "\n")
+		if e.Line <= len(lines) {
+			e.Text = strings.TrimSuffix(lines[e.Line-1], "\r")
+		}
+	}
+}
+
+// LimitError is the error a program gives when it grows
+// something past one of the limits it was compiled with.  It
+// usually comes wrapped in a RuntimeError, which says where.
+type LimitError struct {
+	Limit string // what got too big, like "pattern space"
+	Max   int    // the limit it went past
+	Unit  string // what Max counts, like "bytes"
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("the %s is over its limit of %d %s", e.Limit, e.Max, e.Unit)
+}
+
+// InputError is an input that couldn't be read.  When an input fails
+// before giving up any of its text (say, a file that can't be opened),
+// the run moves on to the next one, the way a UNIX sed does, and the
+// errors come back as InputErrors once all of the output is read.
+type InputError struct {
+	Input string // the name of the input
+	Err   error  // what went wrong
+}
+
+func (e *InputError) Error() string {
+	err := e.Err
+	var pe *fs.PathError
+	if errors.As(err, &pe) && pe.Path == e.Input {
+		err = pe.Err // don't name the file twice
+	}
+	return fmt.Sprintf("can't read %s: %v", e.Input, err)
+}
+
+// Unwrap gives the underlying error.
+func (e *InputError) Unwrap() error {
+	return e.Err
+}
+
+// InputErrors are all of the inputs that were skipped in a run.
+type InputErrors []*InputError
+
+func (es InputErrors) Error() string {
+	msgs := make([]string, len(es))
+	for idx, e := range es {
+		msgs[idx] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap gives the first of the errors.
+func (es InputErrors) Unwrap() error {
+	if len(es) == 0 {
+		return nil
+	}
+	return es[0]
+}
+
+// origin is where an instruction came from in the program,
+// so that runtime errors can point back at it.
+type origin struct {
+	location
+	letter rune // the command letter, or 0 for the parts of every program
+}
+
+func newOrigin(tok *token) origin {
+	if tok == nil {
+		return origin{}
+	}
+	return origin{tok.location, tok.letter}
+}
+
+// RuntimeError is an error from a command as the program ran, like
+// a 'w' command that couldn't open its file.  It knows where the
+// command is in the program, and which line of input it was on.
+type RuntimeError struct {
+	Command   rune   // the command letter, or 0 for reading the next line
+	Source    string // the piece of a Script the command is in, or ""
+	Line      int    // the line of the command in the program
+	Column    int    // the character on that line
+	Input     string // the name of the input, "-" for an unnamed one
+	InputLine int    // the line number of the input
+	Err       error  // what went wrong
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Command == 0 {
+		return fmt.Sprintf("%v (on line %d of input %s)", e.Err, e.InputLine, e.Input)
+	}
+	loc := location{name: e.Source, line: e.Line, pos: e.Column}
+	return fmt.Sprintf("%v (in the '%c' command %v, on line %d of input %s)",
+		e.Err, e.Command, &loc, e.InputLine, e.Input)
+}
+
+// Unwrap gives the underlying error.
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
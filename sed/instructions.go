@@ -1,17 +1,118 @@
 package sed
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 var fullBuffer = errors.New("FullBuffer")
 
+// writeString puts str into the output, with the line endings
+// fixed to match the current line.
 func writeString(svm *vm, str string) error {
+	return writeFixed(svm, fixEndings(svm, str))
+}
+
+// writeFixed puts str into the output as it is, for text whose
+// line endings are already right.  If the last line we wrote was
+// missing its newline (see writeLine), the newline is put back
+// first, since more output follows it.
+func writeFixed(svm *vm, str string) error {
+	if svm.missingnl {
+		svm.missingnl = false
+		str = fixEndings(svm, svm.sep) + str
+	}
+	if svm.limits.output > 0 {
+		if svm.written+len(str) > svm.limits.output {
+			return &LimitError{Limit: "output", Max: svm.limits.output, Unit: "bytes"}
+		}
+		svm.written += len(str)
+	}
+	return writeRaw(svm, str)
+}
+
+// lineEnd is the end of line that the output should use
+// for the current line.
+func lineEnd(svm *vm) string {
+	if svm.ending == CRLFEndings || (svm.ending == PreserveEndings && svm.patcr) {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// fixEndings rewrites the newlines in str to match the line
+// ending we're using, which only matters when lines are
+// separated by newlines in the first place.
+func fixEndings(svm *vm, str string) string {
+	switch {
+	case svm.sep != "\n":
+		return str
+	case svm.ending == LFEndings:
+		return strings.Replace(str, "\r\n", "\n", -1)
+	case lineEnd(svm) == "\r\n":
+		str = strings.Replace(str, "\r\n", "\n", -1)
+		return strings.Replace(str, "\n", "\r\n", -1)
+	}
+	return str
+}
+
+// joinEndings is fixEndings for text from the pattern space, where
+// the lines that 'N' joined each keep the line ending they came with.
+// Any newlines past those end like the current line.
+func joinEndings(svm *vm, text string) string {
+	if svm.sep != "\n" || svm.ending != PreserveEndings || len(svm.joincr) == 0 {
+		return fixEndings(svm, text)
+	}
+
+	lines := strings.Split(text, "\n")
+	var out strings.Builder
+	for idx, line := range lines {
+		switch {
+		case idx == 0:
+		case idx > len(svm.joincr):
+			out.WriteString(lineEnd(svm))
+		case svm.joincr[idx-1]:
+			out.WriteString("\r\n")
+		default:
+			out.WriteString("\n")
+		}
+		if idx < len(lines)-1 {
+			line = strings.TrimSuffix(line, "\r")
+		}
+		out.WriteString(line)
+	}
+	return out.String()
+}
+
+// writeLine puts a line of text from the pattern space into the
+// output, followed by the line separator.  The separator is left off
+// when the current input line didn't have one either, which only
+// happens at the very end of the input.
+func writeLine(svm *vm, text string) error {
+	err := writeFixed(svm, joinEndings(svm, text))
+	if err != nil && err != fullBuffer {
+		return err
+	}
+	if svm.patnl {
+		return writeString(svm, svm.sep)
+	}
+	svm.missingnl = true
+	return err
+}
+
+// writeRaw copies str into the output buffer, saving anything
+// that doesn't fit in the overflow.
+func writeRaw(svm *vm, str string) error {
 	var err error
 	end := len(svm.output)
 	src := str
@@ -30,13 +131,58 @@ func writeString(svm *vm, str string) error {
 	return err
 }
 
-func cmd_quit(svm *vm) error {
-	return io.EOF
+// cmd_newQuit makes the 'q' command, which ends the program
+// after putting out any stored-up 'a\'ppended text, like GNU sed.
+func cmd_newQuit(code int) instruction {
+	return func(svm *vm) error {
+		if svm.appl != nil {
+			err := writeString(svm, *svm.appl)
+			svm.appl = nil
+			if err != nil {
+				return err // ok, since IP unchanged
+			}
+		}
+		return quitError(code)
+	}
+}
+
+// cmd_newQuietQuit makes the 'Q' command, which ends the program
+// without printing anything else at all.
+func cmd_newQuietQuit(code int) instruction {
+	return func(svm *vm) error {
+		return quitError(code)
+	}
+}
+
+// quitError is how the program stops: a plain io.EOF for
+// a zero exit code, and an *ExitError for the others.
+func quitError(code int) error {
+	if code == 0 {
+		return io.EOF
+	}
+	return &ExitError{Code: code}
+}
+
+// ---------------------------------------------------
+func cmd_zap(svm *vm) error {
+	svm.pat = ""
+	svm.ip++
+	return nil
+}
+
+// ---------------------------------------------------
+func cmd_filename(svm *vm) error {
+	svm.ip++
+	if err := writeString(svm, svm.filename); err != nil && err != fullBuffer {
+		return err
+	}
+	return writeString(svm, "\n")
 }
 
 // ---------------------------------------------------
 func cmd_swap(svm *vm) error {
 	svm.pat, svm.hold = svm.hold, svm.pat
+	svm.joincr = nil
 	svm.ip++
 	return nil
 }
@@ -44,6 +190,7 @@ func cmd_swap(svm *vm) error {
 // ---------------------------------------------------
 func cmd_get(svm *vm) error {
 	svm.pat = svm.hold
+	svm.joincr = nil
 	svm.ip++
 	return nil
 }
@@ -57,14 +204,14 @@ func cmd_hold(svm *vm) error {
 
 // ---------------------------------------------------
 func cmd_getapp(svm *vm) error {
-	svm.pat = strings.Join([]string{svm.pat, svm.hold}, "\n")
+	svm.pat = strings.Join([]string{svm.pat, svm.hold}, svm.sep)
 	svm.ip++
 	return nil
 }
 
 // ---------------------------------------------------
 func cmd_holdapp(svm *vm) error {
-	svm.hold = strings.Join([]string{svm.hold, svm.pat}, "\n")
+	svm.hold = strings.Join([]string{svm.hold, svm.pat}, svm.sep)
 	svm.ip++
 	return nil
 }
@@ -94,37 +241,100 @@ func cmd_newChangedBranch(target int) instruction {
 	}
 }
 
+// ---------------------------------------------------
+// newUnchangedBranch generates branch instructions with specific
+// targets that only trigger on unmodified pattern spaces (the 'T'
+// command)
+func cmd_newUnchangedBranch(target int) instruction {
+	return func(svm *vm) error {
+		if svm.modified {
+			svm.ip++
+			svm.modified = false
+		} else {
+			svm.ip = target
+		}
+		return nil
+	}
+}
+
 // ---------------------------------------------------
 func cmd_print(svm *vm) error {
 	svm.ip++
-
-	writeString(svm, svm.pat)
-	return writeString(svm, "\n")
+	return writeLine(svm, svm.pat)
 }
 
 // ---------------------------------------------------
 func cmd_printFirstLine(svm *vm) error {
 	svm.ip++
 
-	idx := strings.IndexRune(svm.pat, '\n')
+	idx := strings.Index(svm.pat, svm.sep)
 
 	if idx == -1 {
-		idx = len(svm.pat)
+		return writeLine(svm, svm.pat)
 	}
 
-	writeString(svm, svm.pat[:idx])
-	return writeString(svm, "\n")
+	return writeFixed(svm, joinEndings(svm, svm.pat[:idx+len(svm.sep)]))
+}
+
+// ---------------------------------------------------
+// The 'l' command prints the pattern space in an unambiguous
+// form: backslash escapes for the unprintable characters, a '\'
+// at each wrapped line, and a '$' at the end. A width below 2
+// means no wrapping at all.
+func cmd_newLister(width int) instruction {
+	return func(svm *vm) error {
+		svm.ip++
+
+		var out strings.Builder
+		col := 0
+		emit := func(s string, cols int) {
+			if width > 1 && col+cols > width-1 {
+				out.WriteString("\\\n")
+				col = 0
+			}
+			out.WriteString(s)
+			col += cols
+		}
+
+		pat := svm.pat
+		for len(pat) > 0 {
+			r, size := utf8.DecodeRuneInString(pat)
+			switch {
+			case r == '\\':
+				emit(`\\`, 2)
+			case listEscapes[r] != "":
+				emit(listEscapes[r], 2)
+			case r == utf8.RuneError && size == 1, !unicode.IsPrint(r):
+				for _, b := range []byte(pat[:size]) {
+					emit(fmt.Sprintf("\\%03o", b), 4)
+				}
+			default:
+				emit(pat[:size], 1)
+			}
+			pat = pat[size:]
+		}
+		out.WriteString("$\n")
+
+		return writeString(svm, out.String())
+	}
+}
+
+var listEscapes = map[rune]string{
+	'\a': `\a`, '\b': `\b`, '\f': `\f`, '\n': `\n`, '\r': `\r`, '\t': `\t`, '\v': `\v`,
 }
 
 // ---------------------------------------------------
 func cmd_deleteFirstLine(svm *vm) (err error) {
-	idx := strings.IndexRune(svm.pat, '\n')
+	idx := strings.Index(svm.pat, svm.sep)
 
 	if idx == -1 {
 		svm.pat = ""
 		svm.ip = 0 // go back and fillNext
 	} else {
-		svm.pat = svm.pat[idx+1:]
+		svm.pat = svm.pat[idx+len(svm.sep):]
+		if len(svm.joincr) > 0 {
+			svm.joincr = svm.joincr[1:]
+		}
 		svm.ip = 1 // restart, but skip filling
 	}
 
@@ -161,26 +371,23 @@ func cmd_fillNext(svm *vm) error {
 	svm.ip++
 
 	svm.pat = svm.nxtl
+	svm.patnl = svm.nxtnl
+	svm.patcr = svm.nxtcr
+	svm.joincr = nil
+	svm.filename = svm.nxtname
 	svm.lineno++
 	svm.modified = false
 
-	var prefix = true
-	var line []byte
-
-	var lines []string
+	svm.nxtl, svm.nxtnl, err = readNextRecord(svm)
 
-	for prefix {
-		line, prefix, err = svm.input.ReadLine()
-		if err != nil {
-			break
-		}
-		// buf := make([]byte, len(line))
-		// copy(buf, line)
-		lines = append(lines, string(line))
+	// a CRLF line keeps its CR out of the pattern space, so
+	// '$' works, but we remember it for the output.
+	svm.nxtcr = false
+	if svm.nxtnl && svm.sep == "\n" && strings.HasSuffix(svm.nxtl, "\r") {
+		svm.nxtl = svm.nxtl[:len(svm.nxtl)-1]
+		svm.nxtcr = true
 	}
 
-	svm.nxtl = strings.Join(lines, "")
-
 	if err == io.EOF {
 		if len(svm.nxtl) == 0 {
 			svm.lastl = true
@@ -191,13 +398,72 @@ func cmd_fillNext(svm *vm) error {
 	return err
 }
 
+// readNextRecord reads the next record from the inputs, moving on
+// to the next input whenever the current one runs dry.  Only the end
+// of the last input comes back as io.EOF with an empty record.  An
+// input that fails before giving any text is skipped, and remembered
+// for the end of the run.  Any other read error is an *InputError.
+func readNextRecord(svm *vm) (string, bool, error) {
+	fresh := false
+	for {
+		record, found, err := readRecord(svm.input, svm.sep)
+		if svm.isCanceled(err) {
+			return record, found, err
+		}
+		if fresh && err != nil && err != io.EOF && len(record) == 0 {
+			svm.skipped = append(svm.skipped, &InputError{Input: svm.nxtname, Err: err})
+			err = io.EOF
+		}
+		if err != io.EOF || len(record) > 0 || len(svm.inputs) == 0 {
+			if err != nil && err != io.EOF {
+				err = &InputError{Input: svm.nxtname, Err: err}
+			}
+			return record, found, err
+		}
+		svm.input = bufio.NewReader(svm.inputs[0].Reader)
+		svm.nxtname = svm.inputs[0].Name
+		svm.inputs = svm.inputs[1:]
+		fresh = true
+	}
+}
+
+// readRecord reads up through the next separator, giving back the
+// record without it, and whether the separator was there at all
+// (it is missing at the end of the input).
+func readRecord(rdr *bufio.Reader, sep string) (string, bool, error) {
+	last := sep[len(sep)-1]
+	record, err := rdr.ReadString(last)
+	for err == nil && !strings.HasSuffix(record, sep) {
+		var more string
+		more, err = rdr.ReadString(last)
+		record += more
+	}
+
+	found := strings.HasSuffix(record, sep)
+	if found {
+		record = record[:len(record)-len(sep)]
+	}
+	return record, found, err
+}
+
 func cmd_fillNextAppend(svm *vm) error {
 	var lines = make([]string, 2)
 	lines[0] = svm.pat
+
+	// remember the ending of each line being joined, treating any
+	// newlines that commands put in the line like the line itself
+	joincr := svm.joincr
+	count := strings.Count(lines[0], svm.sep)
+	for len(joincr) < count {
+		joincr = append(joincr, svm.patcr)
+	}
+	joincr = append(joincr[:count:count], svm.patcr)
+
 	err := cmd_fillNext(svm) // usually increments ip for us...
 	if err == nil {
 		lines[1] = svm.pat
-		svm.pat = strings.Join(lines, "\n")
+		svm.pat = strings.Join(lines, svm.sep)
+		svm.joincr = joincr
 	} else if err == io.EOF {
 		// we have to increment ip when we are ignoring EOF
 		svm.ip++
@@ -214,7 +480,11 @@ type cmd_simplecond struct {
 }
 
 func (c *cmd_simplecond) run(svm *vm) error {
-	if c.cond.isMet(svm) {
+	met, err := c.cond.isMet(svm)
+	if err != nil {
+		return err
+	}
+	if met {
 		svm.ip = c.metloc
 	} else {
 		svm.ip = c.unmetloc
@@ -224,44 +494,67 @@ func (c *cmd_simplecond) run(svm *vm) error {
 
 // --------------------------------------------------
 type cmd_twocond struct {
-	start    condition // the condition that begines the block
-	end      condition // the condition that ends the block
-	metloc   int       // where to jump if the condition is met
-	unmetloc int       // where to jump if the condition is not met
-	isOn     bool      // are we active already?
-	offFrom  int       // if we saw the end condition, what line was it on?
+	start    condition    // the condition that begines the block
+	end      endcondition // the condition that ends the block
+	metloc   int          // where to jump if the condition is met
+	unmetloc int          // where to jump if the condition is not met
+	slot     int          // index of our rangeState in the vm
+}
+
+// rangeState is the per-run state of a cmd_twocond.  It
+// lives in the vm rather than the instruction, so that one
+// compiled Engine can run against many inputs at once.
+type rangeState struct {
+	isOn    bool // are we active already?
+	first   int  // the line number where the range started
+	offFrom int  // if we saw the end condition, what line was it on?
 }
 
-func newTwoCond(c1 condition, c2 condition, metloc int, unmetloc int) *cmd_twocond {
-	return &cmd_twocond{c1, c2, metloc, unmetloc, false, 0}
+func newTwoCond(c1 condition, c2 endcondition, metloc int, unmetloc int, slot int) *cmd_twocond {
+	return &cmd_twocond{c1, c2, metloc, unmetloc, slot}
 }
 
 // isLastLine is here to support multi-line "c\" commands.
 // The command needs to know when it's the end of the
 // section so it can do the replacement.
 func (c *cmd_twocond) isLastLine(svm *vm) bool {
-	return c.isOn && (c.offFrom == svm.lineno)
+	rs := &svm.ranges[c.slot]
+	return rs.isOn && (rs.offFrom == svm.lineno)
 }
 
 func (c *cmd_twocond) run(svm *vm) error {
-	if c.isOn && (c.offFrom > 0) && (c.offFrom < svm.lineno) {
-		c.isOn = false
-		c.offFrom = 0
+	rs := &svm.ranges[c.slot]
+	if rs.isOn && (rs.offFrom > 0) && (rs.offFrom < svm.lineno) {
+		rs.isOn = false
+		rs.offFrom = 0
 	}
 
-	if !c.isOn {
-		if c.start.isMet(svm) {
-			svm.ip = c.metloc
-			c.isOn = true
-		} else {
+	if !rs.isOn {
+		started, err := c.start.isMet(svm)
+		if err != nil {
+			return err
+		}
+		if !started {
 			svm.ip = c.unmetloc
+			return nil
 		}
-	} else {
-		if c.end.isMet(svm) {
-			c.offFrom = svm.lineno
+		rs.isOn = true
+		rs.first = svm.lineno
+		if _, ok := c.start.(zerocond); ok {
+			rs.first = 0
+		}
+	}
+
+	if rs.offFrom == 0 {
+		ended, err := c.end.isEnd(svm, rs.first)
+		if err != nil {
+			return err
+		}
+		if ended {
+			rs.offFrom = svm.lineno
 		}
-		svm.ip = c.metloc
 	}
+	svm.ip = c.metloc
 	return nil
 }
 
@@ -282,16 +575,21 @@ func cmd_newChanger(text string, guard *cmd_twocond) instruction {
 func cmd_newAppender(text string) instruction {
 	return func(svm *vm) error {
 		svm.ip++
-		if svm.appl == nil {
-			svm.appl = &text
-		} else {
-			var newstr = *svm.appl + text
-			svm.appl = &newstr
-		}
+		appendText(svm, text)
 		return nil
 	}
 }
 
+// appendText queues up text to print at the end of the cycle.
+func appendText(svm *vm, text string) {
+	if svm.appl == nil {
+		svm.appl = &text
+	} else {
+		var newstr = *svm.appl + text
+		svm.appl = &newstr
+	}
+}
+
 // --------------------------------------------------
 func cmd_newInserter(text string) instruction {
 	return func(svm *vm) error {
@@ -303,11 +601,25 @@ func cmd_newInserter(text string) instruction {
 // --------------------------------------------------
 // The 'r' command is basically and 'a\' with the contents
 // of a filsvm. I implement it literally that way below.
-func cmd_newReader(filename string) (instruction, error) {
-	bytes, err := ioutil.ReadFile(filename)
+func cmd_newReader(filename string, fsys fs.FS) (instruction, error) {
+	f, err := openFile(fsys, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	bytes, err := ioutil.ReadAll(f)
 	return cmd_newAppender(string(bytes)), err
 }
 
+// openFile opens a file for the 'r' and 'R' commands, from
+// fsys if the engine was given one (see WithFS).
+func openFile(fsys fs.FS, filename string) (io.ReadCloser, error) {
+	if fsys != nil {
+		return fsys.Open(filename)
+	}
+	return os.Open(filename)
+}
+
 // --------------------------------------------------
 // The 'w' command appends the current pattern space
 // to the named filsvm.  In this implementation, it opens
@@ -317,14 +629,111 @@ func cmd_newReader(filename string) (instruction, error) {
 func cmd_newWriter(filename string) instruction {
 	return func(svm *vm) error {
 		svm.ip++
-		f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-		if err == nil {
-			defer f.Close()
-			_, err = f.WriteString(svm.pat)
+		return writeToFile(svm, filename, svm.pat)
+	}
+}
+
+// --------------------------------------------------
+// The 'W' command is like 'w', but only writes the
+// first line of the pattern space.
+func cmd_newFirstLineWriter(filename string) instruction {
+	return func(svm *vm) error {
+		svm.ip++
+		line := svm.pat
+		if idx := strings.Index(line, svm.sep); idx >= 0 {
+			line = line[:idx]
+		}
+		return writeToFile(svm, filename, line)
+	}
+}
+
+// --------------------------------------------------
+// The 'R' command queues up the next line of a file to
+// be appended at the end of the cycle, just like 'a\'.
+// Since each run reads through the file on its own, the
+// open files are kept in the vm.
+func cmd_newLineReader(filename string, fsys fs.FS) instruction {
+	return func(svm *vm) error {
+		svm.ip++
+
+		rdr, ok := svm.rfiles[filename]
+		if !ok {
+			f, err := openFile(fsys, filename)
+			if err == nil {
+				rdr = bufio.NewReader(f)
+				svm.openFiles = append(svm.openFiles, f)
+			}
+			// an unreadable file is just treated as empty, like GNU sed
+			if svm.rfiles == nil {
+				svm.rfiles = make(map[string]*bufio.Reader)
+			}
+			svm.rfiles[filename] = rdr
 		}
-		if err == nil {
-			_, err = f.WriteString("\n")
+		if rdr == nil {
+			return nil
 		}
-		return err
+
+		line, _, err := readRecord(rdr, svm.sep)
+		if len(line) == 0 && err != nil {
+			return nil // at the end of the file, or an error, just stop appending
+		}
+		appendText(svm, line+svm.sep)
+		return nil
+	}
+}
+
+// --------------------------------------------------
+// The 'e' command runs a shell command.  With no command, it
+// runs the pattern space and replaces it with the output, like
+// the 'e' modifier of 's'.  Otherwise the output of the command
+// goes out right away.
+func cmd_newExecuter(command string) instruction {
+	return func(svm *vm) error {
+		svm.ip++
+		if len(command) == 0 {
+			out, err := execCommand(svm, svm.pat)
+			svm.pat = strings.TrimSuffix(out, "\n")
+			return err
+		}
+		out, err := execCommand(svm, command)
+		if err != nil {
+			return err
+		}
+		return writeString(svm, out)
+	}
+}
+
+// execCommand runs a command with the shell, and gives back
+// its output.  A command that runs but fails is not an error,
+// as with GNU sed.  The command is killed if the run's context
+// is done before it finishes.
+func execCommand(svm *vm, command string) (string, error) {
+	ctx := svm.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	out, err := exec.CommandContext(ctx, "sh", "-c", command).Output()
+	if ctx.Err() != nil {
+		return string(out), ctx.Err()
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		err = nil // the command ran, it just wasn't happy
+	}
+	return string(out), err
+}
+
+// writeToFile appends a line of text to the named file, for
+// the 'w' command and the 's///w' modifier.  Like GNU sed, the
+// name /dev/stdout means the output of the engine itself.
+func writeToFile(svm *vm, filename string, text string) error {
+	if filename == "/dev/stdout" {
+		return writeLine(svm, text)
 	}
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err == nil {
+		defer f.Close()
+		_, err = f.WriteString(fixEndings(svm, text+svm.sep))
+	}
+	return err
 }
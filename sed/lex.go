@@ -19,16 +19,23 @@ import (
 )
 
 type location struct {
+	name string // the piece of a Script, or "" for a plain program
+	part int    // the index of that piece
 	line int
 	pos  int
 }
 
 func (l *location) String() string {
+	if l.name != "" {
+		return fmt.Sprintf("at line %d, pos %d of %s", l.line, l.pos, l.name)
+	}
 	return fmt.Sprintf("at line %d, pos %d", l.line, l.pos)
 }
 
 const (
 	tok_NUM = iota
+	tok_STEP
+	tok_OFFSET
 	tok_RX
 	tok_COMMA
 	tok_BANG
@@ -39,6 +46,7 @@ const (
 	tok_CMD
 	tok_CHANGE
 	tok_LABEL
+	tok_ERROR // a lexing error, with the message as its argument
 )
 
 type token struct {
@@ -48,17 +56,67 @@ type token struct {
 	args   []string
 }
 
+// String gives back the text of the token, more or less,
+// for error messages.
+func (t *token) String() string {
+	switch t.typ {
+	case tok_NUM:
+		return t.args[0]
+	case tok_STEP:
+		return t.args[0] + "~" + t.args[1]
+	case tok_OFFSET:
+		return string(t.letter) + t.args[0]
+	case tok_RX:
+		return "/" + t.args[0] + "/" + t.args[1]
+	case tok_LABEL:
+		return ":" + t.args[0]
+	case tok_EOL:
+		return ";"
+	default:
+		return string(t.letter)
+	}
+}
+
 // ----------------------------------------------------------
 //  Location-tracking reader
 // ----------------------------------------------------------
 type locReader struct {
 	location
-	eol bool // state for end of line, true when last rune was '\n'
-	r   *bufio.Reader
+	eol   bool // state for end of line, true when last rune was '\n'
+	r     *bufio.Reader
+	parts []Input // the pieces of the program still to be read
+}
+
+// nextPart moves on to the next piece of the program, if there
+// is one.  Every piece but the last ends in a newline, so that a
+// command never runs from one piece into the next.
+func (lr *locReader) nextPart() bool {
+	if len(lr.parts) == 0 {
+		return false
+	}
+
+	var rdr io.Reader = lr.parts[0].Reader
+	if len(lr.parts) > 1 {
+		rdr = io.MultiReader(rdr, strings.NewReader("\n"))
+	}
+	if lr.r != nil {
+		lr.part++
+	}
+	lr.r = bufio.NewReader(rdr)
+	lr.name = lr.parts[0].Name
+	lr.parts = lr.parts[1:]
+
+	lr.line = 0
+	lr.pos = 0
+	lr.eol = true
+	return true
 }
 
 func (lr *locReader) ReadRune() (rune, int, error) {
 	r, i, err := lr.r.ReadRune()
+	for err == io.EOF && lr.nextPart() {
+		r, i, err = lr.r.ReadRune()
+	}
 
 	lr.pos++
 
@@ -91,8 +149,20 @@ func (lr *locReader) ReadLine() (nxtl string, err error) {
 
 	var lines []string
 
+	if lr.eol {
+		lr.line++
+		lr.pos = 0
+		lr.eol = false
+	}
+
 	for prefix {
 		line, prefix, err = lr.r.ReadLine()
+		if err == io.EOF && len(lines) == 0 && lr.nextPart() {
+			lr.line = 1
+			lr.eol = false
+			prefix = true
+			continue
+		}
 		if err != nil {
 			break
 		}
@@ -154,23 +224,68 @@ func readNumber(r *locReader, character rune) (string, error) {
 	return buffer.String(), err
 }
 
+// readOffset reads the number after a '+' or '~' in
+// the second half of a range.
+func readOffset(r *locReader, prefix rune) (string, error) {
+	character, _, err := r.ReadRune()
+	if err == nil && !unicode.IsDigit(character) {
+		err = fmt.Errorf("expected a number after %c", prefix)
+	}
+	if err != nil {
+		return "", err
+	}
+	return readNumber(r, character)
+}
+
+// readLineAddress reads a line number, which may be followed
+// by a '~step' to make a 'first~step' address.  It returns one
+// string for a plain number, and two for a stepped one.
+func readLineAddress(r *locReader, character rune) ([]string, error) {
+	num, err := readNumber(r, character)
+	if err != nil {
+		return []string{num}, err
+	}
+
+	character, _, err = r.ReadRune()
+	if err != nil {
+		return []string{num}, err
+	}
+	if character != '~' {
+		return []string{num}, r.UnreadRune()
+	}
+
+	step, err := readOffset(r, character)
+	return []string{num, step}, err
+}
+
 // readDelimited reads until it finds the delimter character,
 // returning the string (not including the delimiter). It does
-// allow the delimiter to be escaped by a backslash ('\').
+// allow the delimiter to be escaped by a backslash ('\'), and
+// like GNU sed, an escaped delimiter comes back as just the
+// delimiter: the regexp of s|a\|b|| is 'a|b', which means
+// whatever 'a|b' means in the program's dialect.  Other escapes
+// are left alone, including \n when 'n' is the delimiter.
 // It is an error to reach EOL while looking for the delimiter.
 func readDelimited(r *locReader, delimiter rune) (string, error) {
 	var buffer bytes.Buffer
 
 	var err error
 	var character rune
-	var previous rune
 
 	character, _, err = r.ReadRune()
 	for (err == nil) &&
 		(character != '\n') &&
-		((character != delimiter) || (previous == '\\')) {
+		(character != delimiter) {
+		if character == '\\' {
+			character, _, err = r.ReadRune()
+			if (err != nil) || (character == '\n') {
+				break
+			}
+			if (character != delimiter) || (delimiter == 'n') {
+				buffer.WriteRune('\\')
+			}
+		}
 		buffer.WriteRune(character)
-		previous = character
 		character, _, err = r.ReadRune()
 	}
 
@@ -185,10 +300,49 @@ func readDelimited(r *locReader, delimiter rune) (string, error) {
 	return buffer.String(), err
 }
 
+// readAddressRegexp reads a regexp address, which is either /re/
+// or \cREc for any delimiter c. It returns the regexp and any 'I'
+// or 'M' flags that directly follow it.
+func readAddressRegexp(r *locReader, start rune) ([]string, error) {
+	var ans = make([]string, 2)
+	var err error
+
+	delimiter := start
+	if start == '\\' {
+		delimiter, _, err = r.ReadRune()
+		if err == nil && (delimiter == '\n' || delimiter == '\\') {
+			err = fmt.Errorf("bad delimiter for a regexp address")
+		}
+		if err != nil {
+			return ans, err
+		}
+	}
+
+	ans[0], err = readDelimited(r, delimiter)
+	if err != nil {
+		return ans, err
+	}
+
+	var flag rune
+	for {
+		flag, _, err = r.ReadRune()
+		if err != nil || (flag != 'I' && flag != 'M') {
+			break
+		}
+		ans[1] += string(flag)
+	}
+	if err == nil {
+		err = r.UnreadRune()
+	}
+
+	return ans, err
+}
+
 // readReplacement reads until it finds the delimter character,
 // returning the string (not including the delimiter). It does
-// allow the delimiter to be escaped by a backslash ('\'), and it
-// does interpret a few common backslash escapes like \n and \t.
+// allow the delimiter and the newline to be escaped by a backslash ('\'),
+// but all other escapes are left in place, since their meaning depends
+// on the regexp dialect (see translateReplacement).
 // It is an error to reach an unescaped EOL while looking for the delimiter.
 func readReplacement(r *locReader, delimiter rune) (string, error) {
 	var buffer bytes.Buffer
@@ -207,16 +361,13 @@ func readReplacement(r *locReader, delimiter rune) (string, error) {
 		if previous == '\\' {
 			// find out what we escaped...
 			switch character {
-			case 'r':
-				buffer.WriteRune('\r')
-			case 't':
-				buffer.WriteRune('\t')
-			case 'n':
-				buffer.WriteRune('\n')
-			case '\\':
+			case delimiter, '\n':
 				buffer.WriteRune(character)
+			case '\\':
+				buffer.WriteString(`\\`)
 				character = ' ' // don't escape the next one
 			default:
+				buffer.WriteRune('\\')
 				buffer.WriteRune(character)
 			}
 		} else {
@@ -302,8 +453,50 @@ func readIdentifier(r *locReader) (string, error) {
 	return buffer.String(), err
 }
 
+// readOptionalNumber skips spaces and tabs, and then reads a
+// number if there is one. If there's no number, it returns
+// the empty string.
+func readOptionalNumber(r *locReader) (string, error) {
+	var err error
+	var character rune = ' '
+	for (err == nil) && (character == ' ' || character == '\t') {
+		character, _, err = r.ReadRune()
+	}
+	if err != nil {
+		return "", err
+	}
+	if !unicode.IsDigit(character) {
+		return "", r.UnreadRune()
+	}
+	return readNumber(r, character)
+}
+
+// readRestOfLine skips any leading spaces and tabs, and then
+// reads everything up to the end of the line.
+func readRestOfLine(r *locReader) (string, error) {
+	var buffer bytes.Buffer
+
+	var err error
+	var character rune = ' '
+	for (err == nil) && (character == ' ' || character == '\t') {
+		character, _, err = r.ReadRune()
+	}
+	for (err == nil) && (character != '\n') {
+		buffer.WriteRune(character)
+		character, _, err = r.ReadRune()
+	}
+
+	if err == nil {
+		err = r.UnreadRune()
+	}
+	return buffer.String(), err
+}
+
+// readSubstitution reads the arguments of an 's' command: the
+// regexp, the replacement, the modifiers and, when there is
+// a 'w' modifier, the filename that follows it.
 func readSubstitution(r *locReader) ([]string, error) {
-	var ans = make([]string, 3)
+	var ans = make([]string, 4)
 	var err error
 
 	// step 1.: get the delimiter character for substitutions
@@ -328,6 +521,17 @@ func readSubstitution(r *locReader) ([]string, error) {
 	// step 4.: read the modifiers
 	ans[2], err = readIdentifier(r)
 
+	// step 5.: everything after a 'w' is the filename
+	if idx := strings.IndexRune(ans[2], 'w'); idx >= 0 && (err == nil || err == io.EOF) {
+		ans[2], ans[3] = ans[2][:idx], ans[2][idx+1:]
+		if len(ans[3]) == 0 && err == nil {
+			ans[3], err = readIdentifier(r)
+		}
+		if len(ans[3]) == 0 && (err == nil || err == io.EOF) {
+			err = fmt.Errorf("missing filename for the 'w' modifier")
+		}
+	}
+
 	return ans, err
 }
 
@@ -357,13 +561,11 @@ func readTranslation(r *locReader) ([]string, error) {
 	return ans, err
 }
 
-func lex(r *bufio.Reader, ch chan<- *token, errch chan<- error) {
+func lex(parts []Input, ch chan<- *token) {
 	defer close(ch)
-	defer close(errch)
 
-	rdr := locReader{}
-	rdr.r = r
-	rdr.eol = true
+	rdr := locReader{parts: parts}
+	rdr.nextPart()
 
 	var err error
 	var cur rune
@@ -378,64 +580,90 @@ func lex(r *bufio.Reader, ch chan<- *token, errch chan<- error) {
 
 		topLoc = rdr.location // remember the start of the command
 
+		var tok *token
 		switch cur {
 		case ';':
-			ch <- &token{topLoc, tok_EOL, cur, nil}
+			tok = &token{topLoc, tok_EOL, cur, nil}
 		case ',':
-			ch <- &token{topLoc, tok_COMMA, cur, nil}
+			tok = &token{topLoc, tok_COMMA, cur, nil}
 		case '{':
-			ch <- &token{topLoc, tok_LBRACE, cur, nil}
+			tok = &token{topLoc, tok_LBRACE, cur, nil}
 		case '}':
-			ch <- &token{topLoc, tok_RBRACE, cur, nil}
+			tok = &token{topLoc, tok_RBRACE, cur, nil}
 		case '!':
-			ch <- &token{topLoc, tok_BANG, cur, nil}
-		case '/':
-			var rx string
-			rx, err = readDelimited(&rdr, '/')
-			ch <- &token{topLoc, tok_RX, cur, []string{rx}}
+			tok = &token{topLoc, tok_BANG, cur, nil}
+		case '/', '\\': // a regexp, or a \cREc regexp with a custom delimiter
+			var args []string
+			args, err = readAddressRegexp(&rdr, cur)
+			tok = &token{topLoc, tok_RX, cur, args}
 		case '$':
-			ch <- &token{topLoc, tok_DOLLAR, cur, nil}
+			tok = &token{topLoc, tok_DOLLAR, cur, nil}
+		case '+', '~': // the second half of 'addr,+N' or 'addr,~N'
+			var num string
+			num, err = readOffset(&rdr, cur)
+			tok = &token{topLoc, tok_OFFSET, cur, []string{num}}
 		case ':':
 			var label string
 			label, err = readIdentifier(&rdr)
-			ch <- &token{topLoc, tok_LABEL, cur, []string{label}}
-		case 'b', 't': // branches...
+			tok = &token{topLoc, tok_LABEL, cur, []string{label}}
+		case 'b', 't', 'T': // branches...
 			var label string
 			label, err = readIdentifier(&rdr)
-			ch <- &token{topLoc, tok_CMD, cur, []string{label}}
+			tok = &token{topLoc, tok_CMD, cur, []string{label}}
 		case 's': // substitution
 			var args []string
 			args, err = readSubstitution(&rdr)
-			ch <- &token{topLoc, tok_CMD, cur, args}
+			tok = &token{topLoc, tok_CMD, cur, args}
 		case 'y': // translation
 			var args []string
 			args, err = readTranslation(&rdr)
-			ch <- &token{topLoc, tok_CMD, cur, args}
+			tok = &token{topLoc, tok_CMD, cur, args}
 		case 'c': // change
 			var txt string
 			txt, err = readMultiLine(&rdr)
-			ch <- &token{topLoc, tok_CHANGE, cur, []string{txt}}
+			tok = &token{topLoc, tok_CHANGE, cur, []string{txt}}
 		case 'i', 'a': // insert or append
 			var txt string
 			txt, err = readMultiLine(&rdr)
-			ch <- &token{topLoc, tok_CMD, cur, []string{txt}}
-		case 'r', 'w':
+			tok = &token{topLoc, tok_CMD, cur, []string{txt}}
+		case 'l', 'q', 'Q': // an optional line width or exit code
+			var num string
+			num, err = readOptionalNumber(&rdr)
+			tok = &token{topLoc, tok_CMD, cur, []string{num}}
+		case 'e': // execute, with an optional command to run
+			var command string
+			command, err = readRestOfLine(&rdr)
+			tok = &token{topLoc, tok_CMD, cur, []string{command}}
+		case 'v': // version check
+			var version string
+			version, err = readIdentifier(&rdr)
+			tok = &token{topLoc, tok_CMD, cur, []string{version}}
+		case 'r', 'w', 'R', 'W':
 			var fname string
 			fname, err = readIdentifier(&rdr)
-			ch <- &token{topLoc, tok_CMD, cur, []string{fname}}
+			tok = &token{topLoc, tok_CMD, cur, []string{fname}}
 		default:
 			if unicode.IsDigit(cur) {
-				var num string
-				num, err = readNumber(&rdr, cur)
-				ch <- &token{topLoc, tok_NUM, cur, []string{num}}
+				var args []string
+				args, err = readLineAddress(&rdr, cur)
+				if len(args) == 2 {
+					tok = &token{topLoc, tok_STEP, cur, args}
+				} else {
+					tok = &token{topLoc, tok_NUM, cur, args}
+				}
 			} else {
 				// it's just a argument-free command
-				ch <- &token{topLoc, tok_CMD, cur, nil}
+				tok = &token{topLoc, tok_CMD, cur, nil}
 			}
 		}
+
+		// a token that ran into trouble is never sent
+		if err == nil || err == io.EOF {
+			ch <- tok
+		}
 	}
 
 	if err != io.EOF {
-		errch <- fmt.Errorf("Error reading... <%s> %v", err.Error(), &topLoc)
+		ch <- &token{topLoc, tok_ERROR, cur, []string{fmt.Sprintf("Error reading... <%s>", err.Error())}}
 	}
 }
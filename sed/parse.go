@@ -3,6 +3,7 @@ package sed
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 // these functions parse the lex'ed tokens (lex.go) and
@@ -11,10 +12,10 @@ import (
 var zeroBranch = cmd_newBranch(0)
 
 type waitingBranch struct {
-	ip     int       // address of the branch to fix up
-	label  string    // the target label
-	letter rune      // 'b' or 't' branch
-	loc    *location // the original parse location
+	ip     int    // address of the branch to fix up
+	label  string // the target label
+	letter rune   // 'b', 't' or 'T' branch
+	tok    *token // the original branch command
 }
 
 const (
@@ -24,37 +25,82 @@ const (
 type parseState struct {
 	toks       <-chan *token          // our input
 	ins        []instruction          // the compiled instructions
+	origins    []origin               // where each instruction came from
 	branches   []waitingBranch        // references to fix up
 	b_labels   map[string]instruction // named b branch labels
 	t_labels   map[string]instruction // named t branch labels
+	T_labels   map[string]instruction // named T branch labels
 	blockLevel int                    // how deeply nested are our blocks?
 	quiet      bool                   // are we building a quiet engine (-n sed)?
-	err        error                  // record any errors we encounter
+	cfg        *config                // the settings we were compiled with
+	nranges    int                    // how many two-condition ranges need state?
+	braces     []*token               // the open braces, for reporting a missing '}'
+	last       *token                 // the last token we saw, for errors at the end
+	lexFailed  bool                   // did the lexer give up early?
+	errs       SyntaxErrors           // record any errors we encounter
 }
 
-func parse(input <-chan *token, quiet bool) ([]instruction, error) {
-	ps := &parseState{toks: input, b_labels: make(map[string]instruction), t_labels: make(map[string]instruction), quiet: quiet}
+// emit adds an instruction to the program, noting the token it came
+// from (nil for the parts of every program), for runtime errors.
+func (ps *parseState) emit(tok *token, ins instruction) {
+	ps.ins = append(ps.ins, ins)
+	ps.origins = append(ps.origins, newOrigin(tok))
+}
+
+// fail records a syntax error at the given token, or at the last
+// token seen if it's nil.  Parsing carries on, to find any more.
+func (ps *parseState) fail(tok *token, format string, args ...interface{}) {
+	if tok == nil {
+		tok = ps.last
+	}
+	ps.errs = append(ps.errs, newSyntaxError(tok, fmt.Sprintf(format, args...)))
+}
+
+// nextToken gets the next token, handling any lexing errors
+// on the way.  It is not ok at the end of the tokens.
+func (ps *parseState) nextToken() (*token, bool) {
+	for tok := range ps.toks {
+		ps.last = tok
+		if tok.typ != tok_ERROR {
+			return tok, true
+		}
+		ps.fail(tok, "%s", tok.args[0])
+		ps.lexFailed = true
+	}
+	return nil, false
+}
 
-	ps.ins = append(ps.ins, cmd_fillNext)
+func parse(input <-chan *token, cfg *config) (*Engine, error) {
+	ps := &parseState{toks: input, b_labels: make(map[string]instruction), t_labels: make(map[string]instruction), T_labels: make(map[string]instruction), quiet: cfg.quiet, cfg: cfg}
+
+	ps.emit(nil, cmd_fillNext)
 	parse_toplevel(ps)
-	if ps.err == nil && ps.blockLevel > 0 {
-		ps.err = fmt.Errorf("It looks like you are missing a closing brace!")
+	if !ps.lexFailed {
+		for _, brace := range ps.braces {
+			ps.fail(brace, "It looks like you are missing a closing brace!")
+		}
 	}
 
-	// if the parsing failed in some way, just give up now
-	if ps.err != nil {
-		return nil, ps.err
+	// if the lexer gave up, we haven't seen all of the labels,
+	// so there's no point in checking the branches
+	if ps.lexFailed {
+		return nil, ps.errs
 	}
 
 	ps.b_labels[end_of_program_label] = cmd_newBranch(len(ps.ins))
 	ps.t_labels[end_of_program_label] = cmd_newChangedBranch(len(ps.ins))
+	ps.T_labels[end_of_program_label] = cmd_newUnchangedBranch(len(ps.ins))
 	if !ps.quiet {
-		ps.ins = append(ps.ins, cmd_print)
+		ps.emit(nil, cmd_print)
 	}
-	ps.ins = append(ps.ins, zeroBranch)
+	ps.emit(nil, zeroBranch)
 	parse_resolveBranches(ps)
+	if len(ps.errs) > 0 {
+		ps.errs.sortByPosition()
+		return nil, ps.errs
+	}
 
-	return ps.ins, ps.err
+	return &Engine{ins: ps.ins, origins: ps.origins, nranges: ps.nranges, sep: ps.cfg.sep, ending: ps.cfg.ending}, nil
 }
 
 func parse_resolveBranches(ps *parseState) {
@@ -64,21 +110,29 @@ func parse_resolveBranches(ps *parseState) {
 			ins instruction
 			ok  bool
 		)
-		if waiting[idx].letter == 'b' {
+		switch waiting[idx].letter {
+		case 'b':
 			ins, ok = ps.b_labels[waiting[idx].label]
-		} else {
+		case 't':
 			ins, ok = ps.t_labels[waiting[idx].label]
+		default:
+			ins, ok = ps.T_labels[waiting[idx].label]
 		}
 		if !ok {
-			ps.err = fmt.Errorf("unknown label %s %v", waiting[idx].label, waiting[idx].loc)
-			break
+			ps.fail(waiting[idx].tok, "unknown label %s", waiting[idx].label)
+			continue
 		}
 		ps.ins[waiting[idx].ip] = ins
 	}
 }
 
 func parse_toplevel(ps *parseState) {
-	for tok := range ps.toks {
+	for {
+		tok, ok := ps.nextToken()
+		if !ok {
+			return
+		}
+
 		switch tok.typ {
 		case tok_CMD:
 			compile_cmd(ps, tok)
@@ -87,67 +141,84 @@ func parse_toplevel(ps *parseState) {
 		case tok_NUM:
 			n, err := strconv.Atoi(tok.args[0])
 			if err != nil {
-				ps.err = fmt.Errorf("Bad number <%s> %v", tok.args[0], &tok.location)
-				break
+				ps.fail(tok, "Bad number <%s>", tok.args[0])
+			}
+			if n == 0 {
+				compile_cond(ps, tok, zerocond{})
+			} else {
+				compile_cond(ps, tok, numbercond(n))
+			}
+		case tok_STEP:
+			first, err := strconv.Atoi(tok.args[0])
+			var step int
+			if err == nil {
+				step, err = strconv.Atoi(tok.args[1])
 			}
-			compile_cond(ps, numbercond(n))
+			if err != nil {
+				ps.fail(tok, "Bad number <%s~%s>", tok.args[0], tok.args[1])
+			}
+			compile_cond(ps, tok, stepcond{first, step})
 		case tok_DOLLAR:
-			compile_cond(ps, eofcond{})
+			compile_cond(ps, tok, eofcond{})
 		case tok_RX:
-			var rx condition
-			rx, ps.err = newRECondition(tok.args[0], &tok.location)
-			if ps.err != nil {
-				break
+			rx, err := newRECondition(tok.args[0], tok.args[1], ps.cfg.dialect)
+			if err != nil {
+				// keep going with the rest of the command, to look for more errors
+				ps.fail(tok, "%s", err.Error())
+				rx = &regexpcond{}
 			}
-			compile_cond(ps, rx)
+			compile_cond(ps, tok, rx)
 		case tok_EOL:
 			// top level empty lines are OK
 		case tok_RBRACE:
 			if ps.blockLevel == 0 {
-				ps.err = fmt.Errorf("Unexpected brace %v", &tok.location)
+				ps.fail(tok, "Unexpected brace")
+				break
 			}
 			ps.blockLevel--
+			ps.braces = ps.braces[:len(ps.braces)-1]
 			return
 		default:
-			ps.err = fmt.Errorf("Unexpected token '%c' %v", tok.letter, &tok.location)
-		}
-		if ps.err != nil {
-			break
+			ps.fail(tok, "Unexpected token '%c'", tok.letter)
 		}
 	}
 }
 
 func mustGetToken(ps *parseState) (t *token, ok bool) {
-	t, ok = <-ps.toks
-	if !ok {
-		ps.err = fmt.Errorf("Unexpected end of script!")
+	t, ok = ps.nextToken()
+	if !ok && !ps.lexFailed {
+		ps.fail(nil, "Unexpected end of script!")
 	}
 	return
 }
 
 // compile_cond operates when we see a condition. It looks for
 // a closing condition and an inverter '!'
-func compile_cond(ps *parseState, c condition) {
+func compile_cond(ps *parseState, addr *token, c condition) {
 	tok, ok := mustGetToken(ps)
 	if !ok {
 		return
 	}
 
+	if _, ok := c.(zerocond); ok && tok.typ != tok_COMMA {
+		ps.fail(tok, "Line address 0 is only valid as 0,/re/")
+	}
+
 	switch tok.typ {
 	case tok_COMMA:
-		compile_twocond(ps, c)
+		compile_twocond(ps, addr, c)
 	case tok_BANG:
 		tok, ok = mustGetToken(ps)
 		if !ok {
 			return
 		}
 		sc := &cmd_simplecond{c, 0, len(ps.ins) + 1}
-		ps.ins = append(ps.ins, sc.run)
+		ps.emit(addr, sc.run)
 		compile_block(ps, tok)
 		sc.metloc = len(ps.ins)
 	default:
 		sc := &cmd_simplecond{c, len(ps.ins) + 1, 0}
-		ps.ins = append(ps.ins, sc.run)
+		ps.emit(addr, sc.run)
 		compile_block(ps, tok)
 		sc.unmetloc = len(ps.ins)
 	}
@@ -156,37 +227,53 @@ func compile_cond(ps *parseState, c condition) {
 // compile_twocond operates when we have a comma-separated
 // pair of conditions, and we are expecting to read the second
 // condition next.
-func compile_twocond(ps *parseState, c1 condition) {
+func compile_twocond(ps *parseState, addr *token, c1 condition) {
 	tok, ok := mustGetToken(ps)
 	if !ok {
 		return
 	}
 
-	var c2 condition
+	var c2 endcondition
 
 	switch tok.typ {
 	case tok_NUM:
 		n, err := strconv.Atoi(tok.args[0])
 		if err != nil {
-			ps.err = fmt.Errorf("Bad number <%s> %v", tok.args[0], &tok.location)
-			break
+			ps.fail(tok, "Bad number <%s>", tok.args[0])
 		}
 		c2 = numbercond(n)
+	case tok_OFFSET:
+		n, err := strconv.Atoi(tok.args[0])
+		if err != nil {
+			ps.fail(tok, "Bad number <%c%s>", tok.letter, tok.args[0])
+		}
+		if tok.letter == '+' {
+			c2 = relativecond(n)
+		} else {
+			c2 = multiplecond(n)
+		}
 	case tok_DOLLAR:
 		c2 = eofcond{}
 	case tok_RX:
-		c2, ps.err = newRECondition(tok.args[0], &tok.location)
-		if ps.err != nil {
-			break
+		rx, err := newRECondition(tok.args[0], tok.args[1], ps.cfg.dialect)
+		if err != nil {
+			ps.fail(tok, "%s", err.Error())
+			rx = &regexpcond{}
 		}
+		c2 = rx
 	default:
-		ps.err = fmt.Errorf("Expected a second condition after comma %v", &tok.location)
+		ps.fail(tok, "Expected a second condition after comma")
+		return
 	}
 
-	if ps.err != nil {
-		return
+	if _, ok := c1.(zerocond); ok && tok.typ != tok_RX {
+		ps.fail(tok, "Line address 0 is only valid as 0,/re/")
 	}
 
+	// each range gets a slot for its on/off state in the vm
+	slot := ps.nranges
+	ps.nranges++
+
 	// now, we need to get the next token to determine if we're inverting
 	// the condition...
 	tok, ok = mustGetToken(ps)
@@ -200,20 +287,21 @@ func compile_twocond(ps *parseState, c1 condition) {
 		if !ok {
 			return
 		}
-		tc := newTwoCond(c1, c2, 0, len(ps.ins)+1)
-		ps.ins = append(ps.ins, tc.run)
+		tc := newTwoCond(c1, c2, 0, len(ps.ins)+1, slot)
+		ps.emit(addr, tc.run)
 		compile_block(ps, tok)
 		tc.metloc = len(ps.ins)
 	case tok_CHANGE:
 		// special case for 2-condition change command...
 		// it has to be able to talk to the condition
 		// to know when it's the last line of the change
-		tc := newTwoCond(c1, c2, len(ps.ins)+1, 0)
-		ps.ins = append(ps.ins, tc.run, cmd_newChanger(tok.args[0], tc))
+		tc := newTwoCond(c1, c2, len(ps.ins)+1, 0, slot)
+		ps.emit(addr, tc.run)
+		ps.emit(tok, cmd_newChanger(tok.args[0], tc))
 		tc.unmetloc = len(ps.ins)
 	default:
-		tc := newTwoCond(c1, c2, len(ps.ins)+1, 0)
-		ps.ins = append(ps.ins, tc.run)
+		tc := newTwoCond(c1, c2, len(ps.ins)+1, 0, slot)
+		ps.emit(addr, tc.run)
 		compile_block(ps, tok)
 		tc.unmetloc = len(ps.ins)
 	}
@@ -226,85 +314,167 @@ func compile_block(ps *parseState, cmd *token) {
 	switch cmd.typ {
 	case tok_LBRACE:
 		ps.blockLevel++
+		ps.braces = append(ps.braces, cmd)
 		parse_toplevel(ps)
 	case tok_CMD, tok_CHANGE:
 		compile_cmd(ps, cmd)
 	default:
-		ps.err = fmt.Errorf("Unexpected token '%c' at start of block  %v", cmd.letter, &cmd.location)
+		ps.fail(cmd, "Unexpected token '%c' at start of block", cmd.letter)
 	}
 }
 
 // compile_cmd compiles the individual sed commands
 // into instructions.
 func compile_cmd(ps *parseState, cmd *token) {
+	if ps.cfg.sandbox && strings.ContainsRune("rwRWe", cmd.letter) {
+		ps.fail(cmd, "The '%c' command is not allowed in a sandbox", cmd.letter)
+		return
+	}
+	if ps.cfg.readOnly && strings.ContainsRune("wWe", cmd.letter) {
+		ps.fail(cmd, "The '%c' command is not allowed in a read-only program", cmd.letter)
+		return
+	}
+
 	switch cmd.letter {
 	case '=':
-		ps.ins = append(ps.ins, cmd_lineno)
+		ps.emit(cmd, cmd_lineno)
 	case 'D':
-		ps.ins = append(ps.ins, cmd_deleteFirstLine)
+		ps.emit(cmd, cmd_deleteFirstLine)
+	case 'F':
+		ps.emit(cmd, cmd_filename)
 	case 'G':
-		ps.ins = append(ps.ins, cmd_getapp)
+		ps.emit(cmd, cmd_getapp)
 	case 'H':
-		ps.ins = append(ps.ins, cmd_holdapp)
+		ps.emit(cmd, cmd_holdapp)
 	case 'N':
-		ps.ins = append(ps.ins, cmd_fillNextAppend)
+		ps.emit(cmd, cmd_fillNextAppend)
 	case 'P':
-		ps.ins = append(ps.ins, cmd_printFirstLine)
+		ps.emit(cmd, cmd_printFirstLine)
+	case 'Q':
+		code, ok := compile_optionalNumber(ps, cmd, 0)
+		if ok {
+			ps.emit(cmd, cmd_newQuietQuit(code))
+		}
+	case 'R':
+		ps.emit(cmd, cmd_newLineReader(cmd.args[0], ps.cfg.fsys))
+	case 'W':
+		ps.emit(cmd, cmd_newFirstLineWriter(cmd.args[0]))
 	case 'a':
-		ps.ins = append(ps.ins, cmd_newAppender(cmd.args[0]))
-	case 'b', 't':
+		ps.emit(cmd, cmd_newAppender(cmd.args[0]))
+	case 'b', 't', 'T':
 		compile_branchTarget(ps, len(ps.ins), cmd)
-		ps.ins = append(ps.ins, zeroBranch) // placeholder
+		ps.emit(cmd, zeroBranch) // placeholder
 	case 'c':
-		ps.ins = append(ps.ins, cmd_newChanger(cmd.args[0], nil))
+		ps.emit(cmd, cmd_newChanger(cmd.args[0], nil))
 	case 'd':
-		ps.ins = append(ps.ins, zeroBranch)
+		ps.emit(cmd, zeroBranch)
+	case 'e':
+		if !ps.cfg.allowExec {
+			ps.fail(cmd, "The 'e' command needs the engine to allow command execution")
+			break
+		}
+		ps.emit(cmd, cmd_newExecuter(cmd.args[0]))
 	case 'g':
-		ps.ins = append(ps.ins, cmd_get)
+		ps.emit(cmd, cmd_get)
 	case 'h':
-		ps.ins = append(ps.ins, cmd_hold)
+		ps.emit(cmd, cmd_hold)
 	case 'i':
-		ps.ins = append(ps.ins, cmd_newInserter(cmd.args[0]))
+		ps.emit(cmd, cmd_newInserter(cmd.args[0]))
+	case 'l':
+		width, ok := compile_optionalNumber(ps, cmd, 70)
+		if ok {
+			ps.emit(cmd, cmd_newLister(width))
+		}
 	case 'n':
 		if !ps.quiet {
-			ps.ins = append(ps.ins, cmd_print)
+			ps.emit(cmd, cmd_print)
 		}
-		ps.ins = append(ps.ins, cmd_fillNext)
+		ps.emit(cmd, cmd_fillNext)
 	case 'p':
-		ps.ins = append(ps.ins, cmd_print)
+		ps.emit(cmd, cmd_print)
 	case 'q':
+		code, ok := compile_optionalNumber(ps, cmd, 0)
+		if !ok {
+			break
+		}
 		if !ps.quiet {
-			ps.ins = append(ps.ins, cmd_print)
+			ps.emit(cmd, cmd_print)
 		}
-		ps.ins = append(ps.ins, cmd_quit)
+		ps.emit(cmd, cmd_newQuit(code))
 	case 'r':
-		reader, err := cmd_newReader(cmd.args[0])
+		reader, err := cmd_newReader(cmd.args[0], ps.cfg.fsys)
 		if err != nil {
-			ps.err = fmt.Errorf("'r' command parse: %s %v", err.Error(), &cmd.location)
+			ps.fail(cmd, "'r' command parse: %s", err.Error())
 			break
 		}
-		ps.ins = append(ps.ins, reader)
+		ps.emit(cmd, reader)
 	case 's':
-		subst, err := newSubstitution(cmd.args[0], cmd.args[1], cmd.args[2])
+		subst, err := newSubstitution(cmd.args[0], cmd.args[1], cmd.args[2], cmd.args[3], ps.cfg)
 		if err != nil {
-			ps.err = fmt.Errorf("Substitution parse: %s %v", err.Error(), &cmd.location)
+			ps.fail(cmd, "Substitution parse: %s", err.Error())
 			break
 		}
-		ps.ins = append(ps.ins, subst)
+		ps.emit(cmd, subst)
 	case 'w':
-		ps.ins = append(ps.ins, cmd_newWriter(cmd.args[0]))
+		ps.emit(cmd, cmd_newWriter(cmd.args[0]))
+	case 'v':
+		// 'v' only checks the version, at compile time
+		if err := checkVersion(cmd.args[0]); err != nil {
+			ps.fail(cmd, "%s", err.Error())
+		}
 	case 'x':
-		ps.ins = append(ps.ins, cmd_swap)
+		ps.emit(cmd, cmd_swap)
 	case 'y':
 		trans, err := newTranslation(cmd.args[0], cmd.args[1])
 		if err != nil {
-			ps.err = fmt.Errorf("Translation parse: %s %v", err.Error(), &cmd.location)
+			ps.fail(cmd, "Translation parse: %s", err.Error())
 			break
 		}
-		ps.ins = append(ps.ins, trans)
+		ps.emit(cmd, trans)
+	case 'z':
+		ps.emit(cmd, cmd_zap)
 	default:
-		ps.err = fmt.Errorf("Unknown command '%c' %v", cmd.letter, &cmd.location)
+		ps.fail(cmd, "Unknown command '%c'", cmd.letter)
+	}
+}
+
+// compile_optionalNumber gets the number argument of a
+// command like 'l' or 'q', or the default if there isn't one.
+func compile_optionalNumber(ps *parseState, cmd *token, dflt int) (int, bool) {
+	if len(cmd.args[0]) == 0 {
+		return dflt, true
+	}
+	n, err := strconv.Atoi(cmd.args[0])
+	if err != nil {
+		ps.fail(cmd, "Bad number <%s>", cmd.args[0])
+		return 0, false
+	}
+	return n, true
+}
+
+// gnuVersion is the version of GNU sed whose extensions we
+// claim to support, for the 'v' command.
+var gnuVersion = []int{4, 8}
+
+// checkVersion makes sure that a version given to the 'v'
+// command (like "4.2") is one that we can handle.
+func checkVersion(version string) error {
+	if len(version) == 0 {
+		return nil
+	}
+	for idx, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return fmt.Errorf("Bad version <%s>", version)
+		}
+		if idx >= len(gnuVersion) || n < gnuVersion[idx] {
+			return nil
+		}
+		if n > gnuVersion[idx] {
+			return fmt.Errorf("Expected a newer version of sed (%s)", version)
+		}
 	}
+	return nil
 }
 
 func compile_branchTarget(ps *parseState, ip int, cmd *token) {
@@ -313,13 +483,13 @@ func compile_branchTarget(ps *parseState, ip int, cmd *token) {
 		label = end_of_program_label
 	}
 
-	ps.branches = append(ps.branches, waitingBranch{ip, label, cmd.letter, &cmd.location})
+	ps.branches = append(ps.branches, waitingBranch{ip, label, cmd.letter, cmd})
 }
 
 func compile_label(ps *parseState, lbl *token) {
 	name := lbl.args[0]
 	if len(name) == 0 {
-		ps.err = fmt.Errorf("Bad label name %v", &lbl.location)
+		ps.fail(lbl, "Bad label name")
 		return
 	}
 
@@ -328,4 +498,5 @@ func compile_label(ps *parseState, lbl *token) {
 	// the parse_resolveBranches function.
 	ps.b_labels[name] = cmd_newBranch(len(ps.ins))
 	ps.t_labels[name] = cmd_newChangedBranch(len(ps.ins))
+	ps.T_labels[name] = cmd_newUnchangedBranch(len(ps.ins))
 }
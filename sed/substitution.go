@@ -9,6 +9,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 )
 
@@ -16,18 +17,24 @@ import (
 // -  SUBSTITUTION  -------------------------------------------------
 // ------------------------------------------------------------------
 type substitute struct {
-	pattern     *regexp.Regexp // the pattern to match
-	replacement string         // the template for replacements
+	pattern     *regexp.Regexp // the pattern to match, nil for the last one used
+	replacement *replTemplate  // the template for replacements
 	which       int            // which pattern to replace
 	pflag       bool           // do we print upon replacement?
 	gflag       bool           // do we replace every match after 'which'?
+	eflag       bool           // do we execute the result as a command?
+	wfile       string         // the file to write to upon replacement, if any
 }
 
 func (s *substitute) run(svm *vm) (err error) {
 	svm.ip++
 
 	// perform the search
-	matches := s.pattern.FindAllStringSubmatchIndex(svm.pat, -1)
+	rx, err := svm.useRegexp(s.pattern)
+	if err != nil {
+		return
+	}
+	matches := rx.FindAllStringSubmatchIndex(svm.pat, -1)
 
 	// filter to the matches we want to replace
 	var end int = len(matches)
@@ -42,39 +49,236 @@ func (s *substitute) run(svm *vm) (err error) {
 	matches = matches[s.which:end]
 
 	// perform the replacement
-	svm.pat = subst_replaceAll(svm.pat, s, matches)
+	svm.pat = subst_replaceAll(svm.pat, rx, s.replacement, matches)
 	svm.modified = true
 
+	// execute if requested
+	if s.eflag {
+		svm.pat, err = execCommand(svm, svm.pat)
+		if err != nil {
+			return
+		}
+		svm.pat = strings.TrimSuffix(svm.pat, "\n")
+	}
+
 	// print if requested
 	if s.pflag {
 		err = cmd_print(svm)
 		svm.ip-- // roll back ip from the print command
 	}
 
+	// write if requested
+	if len(s.wfile) > 0 {
+		if werr := writeToFile(svm, s.wfile, svm.pat); err == nil {
+			err = werr
+		}
+	}
+
 	return
 }
 
-func subst_replaceAll(src string, subst *substitute, indexes [][]int) string {
-	var substrings []string
+func subst_replaceAll(src string, rx *regexp.Regexp, repl *replTemplate, indexes [][]int) string {
+	var result []byte
 	endpt := 0 // where we left off in the src string
 	for _, idx := range indexes {
-		exp := string(subst.pattern.ExpandString(nil, subst.replacement, src, idx))
-		substrings = append(substrings, src[endpt:idx[0]], exp)
+		result = append(result, src[endpt:idx[0]]...)
+		result = repl.expand(result, rx, src, idx)
 		endpt = idx[1]
 	}
-	substrings = append(substrings, src[endpt:])
+	result = append(result, src[endpt:]...)
 
-	return strings.Join(substrings, "")
+	return string(result)
 }
 
-func newSubstitution(pattern string, replacement string, mods string) (instruction, error) {
-	rx, err := regexp.Compile(pattern)
-	if err != nil {
-		return nil, err
+// ------------------------------------------------------------------
+// -  REPLACEMENT TEMPLATES  ----------------------------------------
+// ------------------------------------------------------------------
+
+// A replTemplate is the compiled replacement text of a substitution.
+// The template syntax is that of regexp.Expand ($1, ${name}, $$),
+// plus the GNU case conversions:
+//
+//	\U  upper-case until \L or \E
+//	\L  lower-case until \U or \E
+//	\E  stop a \U or \L
+//	\u  upper-case the next character
+//	\l  lower-case the next character
+//
+// and \\ for a literal backslash.
+type replTemplate struct {
+	pieces []replPiece
+}
+
+// a replPiece is one of: literal text, a capture group to copy, or a
+// case conversion to start.  Groups are looked up by name when the
+// template is expanded, since an empty regexp (s//x/) won't know
+// which regexp it is using until then.
+type replPiece struct {
+	text string // the literal text
+	name string // the capture group to copy, or "" for text
+	conv rune   // the case conversion letter, or 0
+}
+
+func newReplTemplate(tmpl string) *replTemplate {
+	t := &replTemplate{}
+	var text []byte
+
+	flush := func() {
+		if len(text) > 0 {
+			t.pieces = append(t.pieces, replPiece{text: string(text)})
+			text = nil
+		}
 	}
 
-	command := &substitute{pattern: rx, replacement: replacement}
+	for i := 0; i < len(tmpl); i++ {
+		c := tmpl[i]
+		switch {
+		case c == '\\' && i+1 < len(tmpl) && strings.IndexByte("ULEul", tmpl[i+1]) >= 0:
+			flush()
+			i++
+			t.pieces = append(t.pieces, replPiece{conv: rune(tmpl[i])})
+		case c == '\\' && i+1 < len(tmpl) && tmpl[i+1] == '\\':
+			i++
+			text = append(text, c)
+		case c == '$' && i+1 < len(tmpl) && tmpl[i+1] == '$':
+			i++
+			text = append(text, c)
+		case c == '$':
+			name, rest, ok := templateGroupName(tmpl[i+1:])
+			if !ok {
+				// malformed, so the $ is just text (like regexp.Expand)
+				text = append(text, c)
+				break
+			}
+			flush()
+			t.pieces = append(t.pieces, replPiece{name: name})
+			i = len(tmpl) - len(rest) - 1
+		default:
+			text = append(text, c)
+		}
+	}
+	flush()
+
+	return t
+}
+
+// templateGroupName pulls the name out of a $name or ${name}
+// reference, returning the rest of the template after it.
+func templateGroupName(tmpl string) (name string, rest string, ok bool) {
+	brace := strings.HasPrefix(tmpl, "{")
+	if brace {
+		tmpl = tmpl[1:]
+	}
+
+	end := 0
+	for end < len(tmpl) {
+		r, size := utf8.DecodeRuneInString(tmpl[end:])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			break
+		}
+		end += size
+	}
+	if end == 0 {
+		return "", tmpl, false
+	}
+	name, rest = tmpl[:end], tmpl[end:]
+
+	if brace {
+		if !strings.HasPrefix(rest, "}") {
+			return "", tmpl, false
+		}
+		rest = rest[1:]
+	}
+	return name, rest, true
+}
+
+// templateGroup finds the capture group for a name, which might
+// be a number.  It returns -1 when there is no such group.
+func templateGroup(name string, rx *regexp.Regexp) int {
+	// like regexp.Expand, a leading zero makes it a name, not a number
+	if num, err := strconv.Atoi(name); err == nil && (name[0] != '0' || len(name) == 1) {
+		if num < 0 || num > rx.NumSubexp() {
+			return -1
+		}
+		return num
+	}
+	for idx, subname := range rx.SubexpNames() {
+		if subname == name {
+			return idx
+		}
+	}
+	return -1
+}
+
+// expand appends the replacement for one match of rx to dst.
+func (t *replTemplate) expand(dst []byte, rx *regexp.Regexp, src string, match []int) []byte {
+	var conv caseConverter
+	for _, p := range t.pieces {
+		switch {
+		case p.conv != 0:
+			conv.set(p.conv)
+		case len(p.name) == 0:
+			dst = conv.append(dst, p.text)
+		default:
+			if group := templateGroup(p.name, rx); group >= 0 && match[2*group] >= 0 {
+				dst = conv.append(dst, src[match[2*group]:match[2*group+1]])
+			}
+		}
+	}
+	return dst
+}
+
+// caseConverter tracks the \U, \L, \u and \l conversions
+// while a replacement is being expanded.
+type caseConverter struct {
+	mode rune // 'U' or 'L' for a running conversion, or 0
+	next rune // 'u' or 'l' for the next character, or 0
+}
+
+func (c *caseConverter) set(conv rune) {
+	switch conv {
+	case 'U', 'L':
+		c.mode = conv
+	case 'E':
+		c.mode = 0
+	case 'u', 'l':
+		c.next = conv
+	}
+}
+
+func (c *caseConverter) append(dst []byte, s string) []byte {
+	if len(s) > 0 && c.next != 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		if c.next == 'u' {
+			r = unicode.ToUpper(r)
+		} else {
+			r = unicode.ToLower(r)
+		}
+		dst = append(dst, string(r)...)
+		s = s[size:]
+		c.next = 0
+	}
+
+	switch c.mode {
+	case 'U':
+		s = strings.ToUpper(s)
+	case 'L':
+		s = strings.ToLower(s)
+	}
+	return append(dst, s...)
+}
+
+func newSubstitution(pattern string, replacement string, mods string, wfile string, cfg *config) (instruction, error) {
+	var err error
+	command := &substitute{wfile: wfile}
+	if len(wfile) > 0 && cfg.sandbox {
+		return nil, fmt.Errorf("The 'w' modifier is not allowed in a sandbox")
+	}
+	if len(wfile) > 0 && cfg.readOnly {
+		return nil, fmt.Errorf("The 'w' modifier is not allowed in a read-only program")
+	}
 	var numbers []rune
+	var reflags string
 
 	for _, char := range mods {
 		switch char {
@@ -82,15 +286,39 @@ func newSubstitution(pattern string, replacement string, mods string) (instructi
 			command.pflag = true
 		case 'g':
 			command.gflag = true
+		case 'i', 'I':
+			reflags += "i"
+		case 'm', 'M':
+			reflags += "m"
+		case 'e':
+			if cfg.sandbox {
+				err = fmt.Errorf("The 'e' modifier is not allowed in a sandbox")
+			} else if cfg.readOnly {
+				err = fmt.Errorf("The 'e' modifier is not allowed in a read-only program")
+			} else if !cfg.allowExec {
+				err = fmt.Errorf("The 'e' modifier needs the engine to allow command execution")
+			}
+			command.eflag = true
 		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
 			numbers = append(numbers, char)
 		default:
-			err = fmt.Errorf("Bad regexp modifier <%v>", char)
+			err = fmt.Errorf("Bad regexp modifier <%c>", char)
 		}
 		if err != nil {
-			break
+			return nil, err
+		}
+	}
+
+	// an empty pattern stays nil, to mean the last regexp used
+	if len(pattern) > 0 {
+		command.pattern, err = compileRegexp(pattern, cfg.dialect, reflags)
+		if err != nil {
+			return nil, err
 		}
+	} else if len(reflags) > 0 {
+		return nil, fmt.Errorf("no flags allowed on an empty regexp")
 	}
+	command.replacement = newReplTemplate(translateReplacement(replacement, cfg.dialect))
 
 	if len(numbers) > 0 {
 		command.which, _ = strconv.Atoi(string(numbers))